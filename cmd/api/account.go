@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"greenlight.twd.net/internal/data"
+	"greenlight.twd.net/internal/validator"
+	"net/http"
+	"time"
+)
+
+// showCurrentUserHandler returns the account details of the authenticated user
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listSessionsHandler lists the places the user is logged in. Each session is the family of
+// tokens issued when the user logged in, which lasts for as long as it keeps being refreshed
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	current, err := app.currentSession(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, current)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteSessionHandler logs the user out of one of their sessions, which can be the current one
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Tokens.DeleteSession(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.revokeSignedTokens(user.ID, id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCurrentUserHandler lets users change their own name, password and email address.
+// Changing the password or email address is sensitive, so the request must also include
+// the user's current password. A new email address doesn't take effect straight away:
+// it's stored as the pending email, and we send a token to it which the user redeems at
+// PUT /v1/users/email to confirm that they can receive mail there.
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Name            *string `json:"name"`
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword *string `json:"current_password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.Email != nil || input.Password != nil {
+		if input.CurrentPassword == nil || *input.CurrentPassword == "" {
+			v.AddError("current_password", "must be provided to change your email address or password")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		matches, err := user.Password.Matches(*input.CurrentPassword)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !matches {
+			v.AddError("current_password", "is incorrect")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	if input.Password != nil {
+		err = user.Password.Set(*input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// asking to change back to the current email address cancels any pending change
+	emailChanged := false
+
+	if input.Email != nil {
+		if *input.Email == user.Email {
+			user.PendingEmail = ""
+		} else {
+			data.ValidateEmail(v, *input.Email)
+			user.PendingEmail = *input.Email
+			emailChanged = true
+		}
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the unique constraint on users.email won't catch a pending email address which
+	// is already taken, so we check for that here
+	if emailChanged {
+		_, err = app.models.Users.GetByEmail(user.PendingEmail)
+		switch {
+		case err == nil:
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		case !errors.Is(err, data.ErrRecordNotFound):
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// after a password change, log the user out everywhere apart from the session
+	// which made this request, and throw away any outstanding password reset tokens
+	if input.Password != nil {
+		current, err := app.currentSession(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// signed access tokens have to be revoked session by session, so that the
+		// current one keeps working
+		sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, current)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		for _, session := range sessions {
+			if session.Current {
+				continue
+			}
+
+			err = app.revokeSignedTokens(user.ID, session.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+			err = app.models.Tokens.DeleteAllForUserExcept(scope, user.ID, current)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		err = app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if emailChanged {
+		// only the token for the most recently requested address should work
+		err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			tokenData := map[string]any{
+				"emailChangeToken": token.Plaintext,
+				"userName":         user.Name,
+			}
+
+			err := app.mailer.Send(user.PendingEmail, "email_change.tmpl", tokenData)
+			if err != nil {
+				app.logger.Error("Failed to send email change confirmation.", "error", err.Error())
+			}
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmEmailChangeHandler redeems an email change token, swapping the user's email address
+// for the pending one. We let the old address know about the change, so that the owner of the
+// account can spot it if somebody else has got hold of their password
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateToken(v, data.ScopeEmailChange, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// the change may have been cancelled since the token was sent
+	if user.PendingEmail == "" {
+		v.AddError("token", "invalid or expired email change token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	oldEmail := user.Email
+
+	user.Email = user.PendingEmail
+	user.PendingEmail = ""
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		notificationData := map[string]any{
+			"newEmail": user.Email,
+			"userName": user.Name,
+		}
+
+		err := app.mailer.Send(oldEmail, "email_changed.tmpl", notificationData)
+		if err != nil {
+			app.logger.Error("Failed to send email change notification.", "error", err.Error())
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
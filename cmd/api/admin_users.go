@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"greenlight.twd.net/internal/data"
+	"greenlight.twd.net/internal/validator"
+	"net/http"
+)
+
+// The handlers in this file let administrators manage other users' accounts. They're
+// guarded by the users:admin permission code in routes.go, although permission
+// administrators can look users up too
+
+// readUser looks up the user identified by the :id URL parameter, returning
+// data.ErrRecordNotFound if the parameter is invalid
+func (app *application) readUser(r *http.Request) (*data.User, error) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return app.models.Users.Get(id)
+}
+
+// selfActionResponse is sent when an administrator tries to deactivate or delete their own
+// account, which would lock them out of the admin endpoints
+func (app *application) selfActionResponse(w http.ResponseWriter, r *http.Request) {
+	app.failedValidationResponse(w, r, map[string]string{"id": "you cannot do this to your own account"})
+}
+
+// listUsersHandler returns a paginated list of users, optionally filtered by a search
+// string which is matched against their name and email address
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Search string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Search = app.readString(qs, "search", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(input.Search, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showUserHandler returns a user along with their roles and effective permission codes
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.readUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "roles": roles, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deactivateUserHandler disables a user's account and logs them out everywhere. Disabled
+// users can't log in again until their account is reactivated
+func (app *application) deactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.setUserDisabled(w, r, true)
+}
+
+// reactivateUserHandler re-enables a disabled account, so that its user can log in again
+func (app *application) reactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.setUserDisabled(w, r, false)
+}
+
+// setUserDisabled does the work for the deactivate and reactivate handlers
+func (app *application) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user, err := app.readUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.ID == app.contextGetUser(r).ID {
+		app.selfActionResponse(w, r)
+		return
+	}
+
+	user.Disabled = disabled
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// a disabled user shouldn't be able to carry on using the tokens they already have,
+	// or get back in by resetting their password
+	if disabled {
+		for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh, data.ScopePasswordReset} {
+			err = app.models.Tokens.DeleteAllForUser(scope, user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		err = app.revokeSignedTokens(user.ID, 0)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeUserTokensHandler logs a user out everywhere by deleting all of their authentication
+// and refresh tokens
+func (app *application) revokeUserTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.readUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err = app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.revokeSignedTokens(user.ID, 0)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "tokens successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteUserHandler permanently deletes a user, along with their tokens and permissions
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if id == app.contextGetUser(r).ID {
+		app.selfActionResponse(w, r)
+		return
+	}
+
+	err = app.models.Users.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showUserLockoutHandler returns whether a user is locked out after too many failed logins,
+// along with how many failed logins there have been for their email address recently
+func (app *application) showUserLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.readUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	lockout, err := app.models.LoginAttempts.GetLock(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	failures, err := app.models.LoginAttempts.FailuresForEmail(user.Email, app.config.login.window)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	status := envelope{
+		"locked":          lockout != nil,
+		"recent_failures": failures.Count,
+	}
+	if lockout != nil {
+		status["locked_at"] = lockout.CreatedAt
+		status["locked_until"] = lockout.LockedUntil
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"lockout": status}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// unlockUserHandler lifts a user's lockout early, and forgets their failed logins
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.readUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.LoginAttempts.Unlock(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.LoginAttempts.ClearForEmail(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
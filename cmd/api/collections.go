@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"greenlight.twd.net/internal/data"
+	"greenlight.twd.net/internal/validator"
+	"net/http"
+)
+
+// canEditCollection reports whether the user may change or delete the collection.
+// Anyone with movies:write (which the routes already require) may edit franchises and
+// their own curated lists, but editing someone else's curated list needs the extra
+// collections:admin permission code
+func (app *application) canEditCollection(r *http.Request, collection *data.Collection) (bool, error) {
+	if collection.Kind == data.CollectionKindFranchise || collection.IsOwnedBy(app.contextGetUser(r).ID) {
+		return true, nil
+	}
+
+	permissions, err := app.contextGetPermissions(r)
+	if err != nil {
+		return false, err
+	}
+
+	return permissions.Include("collections:admin"), nil
+}
+
+// setCollectionOwner makes sure that curated lists are owned by someone and franchises
+// aren't. A curated list which doesn't have an owner yet is given to the current user.
+func setCollectionOwner(collection *data.Collection, user *data.User) {
+	switch {
+	case collection.Kind == data.CollectionKindFranchise:
+		collection.OwnerID = nil
+	case collection.OwnerID == nil:
+		collection.OwnerID = &user.ID
+	}
+}
+
+// unknownMovieResponse is sent when the movie_ids of a collection refer to a movie
+// which doesn't exist
+func (app *application) unknownMovieResponse(w http.ResponseWriter, r *http.Request) {
+	app.failedValidationResponse(w, r, map[string]string{"movie_ids": "must only contain existing movies"})
+}
+
+func (app *application) createCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string  `json:"name"`
+		Description string  `json:"description"`
+		Kind        string  `json:"kind"`
+		MovieIDs    []int64 `json:"movie_ids"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	collection := &data.Collection{
+		Name:        input.Name,
+		Description: input.Description,
+		Kind:        input.Kind,
+		MovieIDs:    input.MovieIDs,
+	}
+
+	// an empty collection is fine, so treat a missing movie_ids field as an empty list
+	if collection.MovieIDs == nil {
+		collection.MovieIDs = []int64{}
+	}
+
+	v := validator.New()
+
+	if data.ValidateCollection(v, collection); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	setCollectionOwner(collection, app.contextGetUser(r))
+
+	err = app.models.Collections.Insert(collection)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrUnknownMovie):
+			app.unknownMovieResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/collections/%d", collection.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"collection": collection}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	collection, err := app.models.Collections.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"collection": collection}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listCollectionsHandler supports searching by name, filtering by kind, paging and sorting
+func (app *application) listCollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string
+		Kind string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Name = app.readString(qs, "name", "")
+	input.Kind = app.readString(qs, "kind", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "created_at", "-id", "-name", "-created_at"}
+
+	if input.Kind != "" {
+		v.Check(validator.PermittedValue(input.Kind, data.CollectionKindFranchise, data.CollectionKindCurated), "kind", "must be one of franchise or curated")
+	}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	collections, metadata, err := app.models.Collections.GetAll(input.Name, input.Kind, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"collections": collections, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCollectionHandler supports partial updates. When movie_ids is given it replaces
+// the whole membership of the collection, in the order given.
+func (app *application) updateCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	collection, err := app.models.Collections.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	allowed, err := app.canEditCollection(r, collection)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		Kind        *string `json:"kind"`
+		MovieIDs    []int64 `json:"movie_ids"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		collection.Name = *input.Name
+	}
+	if input.Description != nil {
+		collection.Description = *input.Description
+	}
+	// changing the kind changes who owns the collection, so anyone who can edit a franchise
+	// could take it over by making it a curated list, and owners could open their lists up
+	// to everyone by making them franchises. Only administrators may do that
+	if input.Kind != nil && *input.Kind != collection.Kind {
+		permissions, err := app.contextGetPermissions(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !permissions.Include("collections:admin") {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		collection.Kind = *input.Kind
+	}
+	if input.MovieIDs != nil {
+		collection.MovieIDs = input.MovieIDs
+	}
+
+	v := validator.New()
+
+	if data.ValidateCollection(v, collection); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	setCollectionOwner(collection, user)
+
+	err = app.models.Collections.Update(collection)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrUnknownMovie):
+			app.unknownMovieResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"collection": collection}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	collection, err := app.models.Collections.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	allowed, err := app.canEditCollection(r, collection)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
+	err = app.models.Collections.Delete(collection.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "collection successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"greenlight.twd.net/internal/data"
 	"net/http"
 )
@@ -13,6 +14,18 @@ type contextKey string
 // We'll use this constant as they key for getting and setting user information in the request context
 const userContextKey = contextKey("user")
 
+// tokenContextKey is the key for the plaintext authentication token the request was made with
+const tokenContextKey = contextKey("token")
+
+// claimsContextKey is the key for the claims of a signed access token the request was made with
+const claimsContextKey = contextKey("claims")
+
+// apiKeyContextKey is the key for the API key the request was made with
+const apiKeyContextKey = contextKey("apiKey")
+
+// permissionsContextKey is the key for the permission codes the requesting user has
+const permissionsContextKey = contextKey("permissions")
+
 // contextSetUser method returns a copy of the request with the provided User struct
 // added to the context. Note that we use our userContextKey constant as the key.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
@@ -32,3 +45,63 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// contextSetToken returns a copy of the request with the plaintext authentication token
+// added to the context, so that handlers can tell which token the client is using
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetToken retrieves the plaintext authentication token from the request context.
+// Anonymous requests don't have one, in which case it returns the empty string
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// contextSetClaims returns a copy of the request with the claims of the signed access token it
+// was made with added to the context
+func (app *application) contextSetClaims(r *http.Request, claims *accessClaims) *http.Request {
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// contextGetClaims retrieves the claims of the signed access token from the request context.
+// Requests made with any other kind of token don't have any, in which case it returns nil
+func (app *application) contextGetClaims(r *http.Request) *accessClaims {
+	claims, _ := r.Context().Value(claimsContextKey).(*accessClaims)
+	return claims
+}
+
+// contextSetApiKey returns a copy of the request with the API key it was made with added to the context
+func (app *application) contextSetApiKey(r *http.Request, key *data.ApiKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetApiKey retrieves the API key from the request context. Requests which weren't made
+// with an API key don't have one, in which case it returns nil
+func (app *application) contextGetApiKey(r *http.Request) *data.ApiKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.ApiKey)
+	return key
+}
+
+// contextSetPermissions returns a copy of the request with the user's permission codes
+// added to the context, so that handlers can make finer grained checks without querying
+// the database again
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// contextGetPermissions retrieves the user's permission codes from the request context. They're
+// only stored by the permission middleware, or by authenticate for signed access tokens and
+// API keys, so any other route gets an error rather than a silently empty set
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, error) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	if !ok {
+		return nil, errors.New("missing permissions value in request context")
+	}
+	return permissions, nil
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"greenlight.twd.net/internal/data"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // LogError is a generic helper for logging an error message along with the current request method and URL
@@ -51,7 +56,16 @@ func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.
 	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
 }
 
+// badRequestResponse sends a 400 Bad Request response. The one exception is a runtime which
+// couldn't be parsed: the JSON itself was fine, so that's reported as a validation error on the
+// runtime field with a 422 Unprocessable Entity response, like any other invalid field
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var runtimeFormatError *data.RuntimeFormatError
+	if errors.As(err, &runtimeFormatError) {
+		app.failedValidationResponse(w, r, map[string]string{"runtime": runtimeFormatError.Message})
+		return
+	}
+
 	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
 }
 
@@ -86,6 +100,21 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+// invalidApiKeyResponse is sent for API keys which don't exist, have expired, or can't be used
+// from the client's IP address. They all get the same response, so as not to give anything away
+func (app *application) invalidApiKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+
+	message := "invalid API key."
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// apiKeyNotAllowedResponse is sent when an API key is used for an endpoint which needs the user to log in
+func (app *application) apiKeyNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an API key"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to view this resource."
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -96,7 +125,37 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *application) accountDisabledResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been disabled, please contact an administrator"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// tooManyLoginAttemptsResponse is sent when a client has to back off before trying to log in
+// again. The Retry-After header tells it how many seconds to wait
+func (app *application) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// accountLockedResponse is sent when a user's account, or an unregistered email address, has
+// been locked after too many failed logins. It's the same as the response for backing off, so
+// that it doesn't give away whether there's an account. The user is told by email instead
+func (app *application) accountLockedResponse(w http.ResponseWriter, r *http.Request, lockout *data.Lockout) {
+	app.tooManyLoginAttemptsResponse(w, r, time.Until(lockout.LockedUntil))
+}
+
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "You do not have sufficient permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) payloadTooLargeResponse(w http.ResponseWriter, r *http.Request, limit int64) {
+	message := fmt.Sprintf("the request body must not be larger than %d bytes", limit)
+	app.errorResponse(w, r, http.StatusRequestEntityTooLarge, message)
+}
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, message string) {
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"greenlight.twd.net/internal/data"
+	"greenlight.twd.net/internal/validator"
+	"net/http"
+)
+
+// readExternalIDParams retrieves the :source and :value URL parameters used by the
+// /v1/movies/by-external/:source/:value endpoints, and runs them through validation
+func (app *application) readExternalIDParams(r *http.Request, v *validator.Validator) (string, string) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	source := params.ByName("source")
+	value := params.ByName("value")
+
+	data.ValidateExternalID(v, source, value)
+
+	return source, value
+}
+
+// showMovieByExternalIDHandler looks up a movie by the identifier a partner feed uses for it
+func (app *application) showMovieByExternalIDHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	source, value := app.readExternalIDParams(r, v)
+	runtimeFormat := app.readRuntimeFormat(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.models.Movies.GetByExternalID(source, value)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	movie.RuntimeFormat = runtimeFormat
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// upsertMovieByExternalIDHandler creates the movie identified by the external ID if it
+// doesn't exist yet, or replaces its details if it does. As this is a PUT, the request
+// body must contain the full movie. Clients may optionally send the version they last
+// saw, in which case the update is rejected with an edit conflict if it has changed.
+// Sending a movie_id attaches the external ID to that existing movie instead of creating a
+// new one, for movies which were added by hand or are already known to another source.
+func (app *application) upsertMovieByExternalIDHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	source, value := app.readExternalIDParams(r, v)
+	runtimeFormat := app.readRuntimeFormat(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var input struct {
+		Title    string       `json:"title"`
+		Year     int32        `json:"year"`
+		Runtime  data.Runtime `json:"runtime"`
+		Genres   []string     `json:"genres"`
+		Synopsis string       `json:"synopsis"`
+		Version  int32        `json:"version"`
+		MovieID  int64        `json:"movie_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	movie := &data.Movie{
+		Title:    input.Title,
+		Year:     input.Year,
+		Runtime:  input.Runtime,
+		Genres:   input.Genres,
+		Synopsis: input.Synopsis,
+		Version:  input.Version,
+	}
+
+	v.Check(input.MovieID >= 0, "movie_id", "must be a positive integer")
+	movie.ID = input.MovieID
+
+	// this is only recorded if the movie is created, updates leave the original creator alone
+	movie.CreatedBy = &app.contextGetUser(r).ID
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	created, err := app.models.Movies.UpsertByExternalID(source, value, movie)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrExternalIDConflict):
+			v.AddError("movie_id", fmt.Sprintf("this %s ID belongs to another movie, or the movie already has a different one", source))
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("movie_id", "no movie with this ID exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// a newly created movie gets a 201 Created response with a Location header,
+	// in the same way as createMovieHandler
+	status := http.StatusOK
+	headers := make(http.Header)
+
+	if created {
+		status = http.StatusCreated
+		headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	}
+
+	movie.RuntimeFormat = runtimeFormat
+
+	err = app.writeJSON(w, status, envelope{"movie": movie}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -5,12 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
+	"greenlight.twd.net/internal/data"
 	"greenlight.twd.net/internal/validator"
 	"io"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Retrieve the "id" URL parameter from the current request context, convert it to an int and return it.
@@ -26,6 +31,19 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// readNumberParam retrieves a named URL parameter holding a season or episode number
+// and converts it to an int32. Unlike IDs, numbers may be zero (season 0 is used for specials)
+func (app *application) readNumberParam(r *http.Request, name string) (int32, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	number, err := strconv.ParseInt(params.ByName(name), 10, 32)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid %s parameter", name)
+	}
+
+	return int32(number), nil
+}
+
 // writeJSON() helper for sending responses. This takes the destination http.ResonseWriter, the HTTP status code to send
 // the data to encode into JSON and a header map containing any additional HTTP headers we want to include in the resp
 func (app *application) writeJSON(w http.ResponseWriter, status int, data any, headers http.Header) error {
@@ -189,6 +207,95 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// readRuntimeFormat returns the format the client wants runtimes written out in. An explicit
+// ?runtime_format= query string parameter takes priority, and is checked with the validator.
+// Otherwise clients can ask for a format with a profile parameter in the Accept header, like
+// "Accept: application/json; profile=runtime-iso8601". Unknown profiles are ignored, and we
+// fall back to the default "<runtime> mins" format.
+func (app *application) readRuntimeFormat(r *http.Request, v *validator.Validator) data.RuntimeFormat {
+	if value := r.URL.Query().Get("runtime_format"); value != "" {
+		format := data.RuntimeFormat(value)
+		v.Check(validator.PermittedValue(format, data.RuntimeFormats...), "runtime_format", "must be one of mins, iso8601 or seconds")
+		return format
+	}
+
+	for _, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		_, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+
+		// the profile parameter is a space separated list
+		for _, profile := range strings.Fields(params["profile"]) {
+			value, found := strings.CutPrefix(profile, "runtime-")
+			if found && validator.PermittedValue(data.RuntimeFormat(value), data.RuntimeFormats...) {
+				return data.RuntimeFormat(value)
+			}
+		}
+	}
+
+	return data.RuntimeFormatMins
+}
+
+// readLocales returns the client's preferred locales, most preferred first. An explicit
+// ?lang= query string parameter (which may be a comma separated list) takes priority,
+// otherwise we parse the Accept-Language header, ordering the tags by their q-values.
+// Any malformed tags, along with the "*" wildcard, are ignored.
+func (app *application) readLocales(r *http.Request) []string {
+	var tags []string
+
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		tags = strings.Split(lang, ",")
+	} else {
+		type weightedTag struct {
+			tag string
+			q   float64
+		}
+
+		var weighted []weightedTag
+
+		for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+			tag, params, _ := strings.Cut(part, ";")
+
+			q := 1.0
+			if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				parsed, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					continue
+				}
+				q = parsed
+			}
+
+			// a q-value of zero means "not acceptable"
+			if q <= 0 {
+				continue
+			}
+
+			weighted = append(weighted, weightedTag{tag: tag, q: q})
+		}
+
+		// use a stable sort so that tags with equal weights keep the client's ordering
+		sort.SliceStable(weighted, func(i, j int) bool {
+			return weighted[i].q > weighted[j].q
+		})
+
+		for _, w := range weighted {
+			tags = append(tags, w.tag)
+		}
+	}
+
+	locales := []string{}
+
+	for _, tag := range tags {
+		locale := data.NormalizeLocale(tag)
+		if locale != "" && data.LocaleRX.MatchString(locale) {
+			locales = append(locales, locale)
+		}
+	}
+
+	return locales
+}
+
 // background accepts an arbitrary function as a parameter
 func (app *application) background(fn func()) {
 	// Increment the WaitGroup counter
@@ -207,3 +314,44 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// remoteIP returns the IP address of the client which made the request
+func (app *application) remoteIP(r *http.Request) (string, error) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	return ip, err
+}
+
+// runPeriodically launches a goroutine which calls fn once every interval for as long as
+// the application is running. Unlike background(), these goroutines aren't tracked by
+// our WaitGroup, as they never finish on their own and would block a graceful shutdown.
+// Any error returned by fn is logged, and we carry on with the next tick regardless.
+func (app *application) runPeriodically(name string, interval time.Duration, fn func() error) {
+	// run executes a single tick, recovering any panic so that one bad run
+	// doesn't stop the job (or take the whole server down)
+	run := func() {
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error(fmt.Sprintf("%v", err), "job", name)
+			}
+		}()
+
+		start := time.Now()
+
+		err := fn()
+		if err != nil {
+			app.logger.Error("Periodic job failed.", "job", name, "error", err.Error())
+			return
+		}
+
+		app.logger.Info("Periodic job completed.", "job", name, "duration", time.Since(start).String())
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			run()
+		}
+	}()
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"greenlight.twd.net/internal/data"
+	"greenlight.twd.net/internal/storage"
+	"greenlight.twd.net/internal/thumbnail"
+	"greenlight.twd.net/internal/validator"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// imageSizes maps the values accepted by the ?size= query string parameter to the
+// maximum width (in pixels) of the thumbnail we generate for that size. The
+// "original" size is always available and is served exactly as it was uploaded
+var imageSizes = map[string]int{
+	"small":  185,
+	"medium": 500,
+	"large":  1000,
+}
+
+// defaultThumbnailFormat is the format thumbnails are served in when the client doesn't
+// ask for one with the ?format= query string parameter
+const defaultThumbnailFormat = "jpeg"
+
+// permittedImageTypes holds the content types we accept for uploads. These are the
+// formats the standard library can decode, which we need to be able to do in order
+// to generate thumbnails
+var permittedImageTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+// maxImagePixels caps the dimensions of uploaded images. A small, highly compressed
+// file can still decode to an enormous bitmap, so we check the header before decoding
+const maxImagePixels = 40_000_000
+
+func (app *application) uploadMoviePosterHandler(w http.ResponseWriter, r *http.Request) {
+	app.uploadMovieImage(w, r, data.ImageKindPoster)
+}
+
+func (app *application) showMoviePosterHandler(w http.ResponseWriter, r *http.Request) {
+	app.showMovieImage(w, r, data.ImageKindPoster)
+}
+
+func (app *application) uploadMovieBackdropHandler(w http.ResponseWriter, r *http.Request) {
+	app.uploadMovieImage(w, r, data.ImageKindBackdrop)
+}
+
+func (app *application) showMovieBackdropHandler(w http.ResponseWriter, r *http.Request) {
+	app.showMovieImage(w, r, data.ImageKindBackdrop)
+}
+
+// uploadMovieImage stores a new poster or backdrop for a movie. Clients can either send
+// the image as the raw request body, or as the "image" field of a multipart/form-data
+// form. The original is saved straight away, and the thumbnails are generated in a
+// background goroutine so the client doesn't have to wait for them.
+func (app *application) uploadMovieImage(w http.ResponseWriter, r *http.Request, kind string) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// read the image data, limiting the size of the request body to the configured maximum
+	maxBytes := app.config.storage.maxUploadBytes
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+	body, err := app.readImageBody(r)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesError):
+			app.payloadTooLargeResponse(w, r, maxBytes)
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	// Don't trust the Content-Type header sent by the client. Instead sniff the
+	// content type from the first bytes of the image data itself
+	contentType := http.DetectContentType(body)
+	if !validator.PermittedValue(contentType, permittedImageTypes...) {
+		app.unsupportedMediaTypeResponse(w, r, "image must be a JPEG, PNG or GIF")
+		return
+	}
+
+	// DecodeConfig() only reads the image header, so this is a cheap way to both check
+	// that the image isn't corrupt and find out its dimensions
+	config, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		app.badRequestResponse(w, r, errors.New("image could not be decoded"))
+		return
+	}
+
+	if config.Width*config.Height > maxImagePixels {
+		app.badRequestResponse(w, r, fmt.Errorf("image must not contain more than %d pixels", maxImagePixels))
+		return
+	}
+
+	// Every upload is stored under a new random key. That way a replacement never
+	// overwrites files which might be being served at the same moment, and thumbnails
+	// being generated for an earlier upload can't clobber the ones for this one
+	key, err := newImageKey(movie.ID, kind)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.storage.Put(key+"/original", bytes.NewReader(body))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// look up the existing image (if any), so we can clean up its files once
+	// the new one has been recorded
+	previous, err := app.models.Images.Get(movie.ID, kind)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	img := &data.MovieImage{
+		MovieID:     movie.ID,
+		Kind:        kind,
+		StorageKey:  key,
+		ContentType: contentType,
+		Size:        int64(len(body)),
+		Width:       config.Width,
+		Height:      config.Height,
+	}
+
+	err = app.models.Images.Upsert(img)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		app.generateThumbnails(movie.ID, kind, key, body)
+
+		if previous != nil {
+			app.deleteImageFiles(previous.StorageKey)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{kind: img}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// generateThumbnails stores a thumbnail of the image in body for every size and format. The
+// original is only decoded once, and then resized for each size
+func (app *application) generateThumbnails(movieID int64, kind, key string, body []byte) {
+	src, err := thumbnail.Decode(body)
+	if err != nil {
+		app.logger.Error("Failed to decode image for thumbnails.", "movieID", movieID, "kind", kind, "error", err.Error())
+		return
+	}
+
+	for size, width := range imageSizes {
+		img := thumbnail.Resize(src, width)
+
+		for name, format := range thumbnail.Formats {
+			buf := new(bytes.Buffer)
+
+			err := format.Encode(buf, img)
+			if err != nil {
+				app.logger.Error("Failed to generate thumbnail.", "movieID", movieID, "kind", kind, "size", size, "format", name, "error", err.Error())
+				continue
+			}
+
+			err = app.storage.Put(thumbnailKey(key, size, name), buf)
+			if err != nil {
+				app.logger.Error("Failed to store thumbnail.", "movieID", movieID, "kind", kind, "size", size, "format", name, "error", err.Error())
+			}
+		}
+	}
+}
+
+// thumbnailKey returns the storage key of a thumbnail. JPEGs have no extension, as they were
+// the only format thumbnails came in at first, and images uploaded then are still stored so
+func thumbnailKey(key, size, format string) string {
+	if format == defaultThumbnailFormat {
+		return key + "/" + size
+	}
+
+	return key + "/" + size + "." + format
+}
+
+// showMovieImage serves a movie's poster or backdrop. The ?size= query string
+// parameter selects either the original upload or one of the generated thumbnails
+func (app *application) showMovieImage(w http.ResponseWriter, r *http.Request, kind string) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	size := app.readString(qs, "size", "original")
+	format := app.readString(qs, "format", "")
+
+	v := validator.New()
+
+	_, ok := imageSizes[size]
+	v.Check(ok || size == "original", "size", "must be one of original, small, medium or large")
+
+	// the original is always served in the format it was uploaded in
+	if format != "" {
+		_, ok := thumbnail.Formats[format]
+		v.Check(ok, "format", "must be jpeg or webp")
+		v.Check(size != "original", "format", "can only be given for thumbnails")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if format == "" {
+		format = defaultThumbnailFormat
+	}
+
+	img, err := app.models.Images.Get(id, kind)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	storageKey := img.StorageKey + "/original"
+	contentType := img.ContentType
+	etag := fmt.Sprintf("%s-%d-%s", kind, img.Version, size)
+
+	if size != "original" {
+		storageKey = thumbnailKey(img.StorageKey, size, format)
+		contentType = thumbnail.Formats[format].ContentType
+		etag += "-" + format
+	}
+
+	// If the thumbnails for a fresh upload haven't been generated yet, the storage
+	// backend will return ErrNotFound and we send a 404 for now
+	file, err := app.storage.Open(storageKey)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", strconv.Quote(etag))
+	w.WriteHeader(http.StatusOK)
+
+	_, err = io.Copy(w, file)
+	if err != nil {
+		app.LogError(r, err)
+	}
+}
+
+// readImageBody returns the uploaded image data from either a multipart/form-data
+// request (using the "image" field) or a raw request body
+func (app *application) readImageBody(r *http.Request) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if mediaType != "multipart/form-data" {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		if len(body) == 0 {
+			return nil, errors.New("body must not be empty")
+		}
+		return body, nil
+	}
+
+	// Use MultipartReader() rather than ParseMultipartForm(), so that we stream the parts
+	// instead of spooling the whole form to memory or temporary files first
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New(`form must contain an "image" file field`)
+			}
+			return nil, err
+		}
+
+		if part.FormName() == "image" {
+			body, err := io.ReadAll(part)
+			part.Close()
+			if err != nil {
+				return nil, err
+			}
+			if len(body) == 0 {
+				return nil, errors.New("image must not be empty")
+			}
+			return body, nil
+		}
+		part.Close()
+	}
+}
+
+// deleteImageFiles removes the original and every thumbnail stored under key
+func (app *application) deleteImageFiles(key string) {
+	keys := []string{key + "/original"}
+	for size := range imageSizes {
+		for format := range thumbnail.Formats {
+			keys = append(keys, thumbnailKey(key, size, format))
+		}
+	}
+
+	for _, k := range keys {
+		err := app.storage.Delete(k)
+		if err != nil {
+			app.logger.Error("Failed to delete image file.", "key", k, "error", err.Error())
+		}
+	}
+}
+
+// newImageKey generates a new, random storage key prefix for a movie image
+func newImageKey(movieID int64, kind string) (string, error) {
+	randomBytes := make([]byte, 8)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("movies/%d/%s/%s", movieID, kind, hex.EncodeToString(randomBytes)), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"greenlight.twd.net/internal/data"
+	"time"
+)
+
+// The helpers in this file protect the login endpoint against password guessing. Failed
+// logins are recorded in the database against both the email address and the IP address
+// they came from, so the limits hold across every instance of the API. After a few
+// failures for an email address, each further attempt has to wait twice as long as the
+// last. Once an account reaches the failure limit it's locked for a while and the user is
+// emailed. IP addresses with too many failures are turned away altogether, which slows
+// down attackers trying one password against lots of accounts.
+
+// freeLoginFailures is how many failed logins an email address gets before backoff kicks in
+const freeLoginFailures = 3
+
+// maxLoginBackoff caps how long the backoff can make a client wait between attempts
+const maxLoginBackoff = 5 * time.Minute
+
+// loginBackoff returns how long to wait after the last of the given number of failed
+// logins before trying again. The delay doubles with each failure past the free ones
+func (app *application) loginBackoff(failures int) time.Duration {
+	if failures < freeLoginFailures {
+		return 0
+	}
+
+	delay := app.config.login.backoff
+	for i := freeLoginFailures; i < failures && delay < maxLoginBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxLoginBackoff)
+}
+
+// loginRetryAfter returns how long the client has to wait before it's allowed to try
+// logging in to the email address from the IP address, or zero if it can go ahead now
+func (app *application) loginRetryAfter(email, ip string) (time.Duration, error) {
+	window := app.config.login.window
+
+	byIP, err := app.models.LoginAttempts.FailuresForIP(ip, window)
+	if err != nil {
+		return 0, err
+	}
+
+	// the IP address can try again once its oldest failure falls out of the window
+	if byIP.Count >= app.config.login.maxIPFailures {
+		return time.Until(byIP.First.Add(window)), nil
+	}
+
+	byEmail, err := app.models.LoginAttempts.FailuresForEmail(email, window)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Until(byEmail.Last.Add(app.loginBackoff(byEmail.Count))), nil
+}
+
+// recordLoginFailure records a failed login, and locks the user's account if that takes
+// it to the failure limit. The user is nil if nobody is registered with the email address,
+// in which case the address itself is locked instead
+func (app *application) recordLoginFailure(email, ip string, user *data.User) error {
+	err := app.models.LoginAttempts.RecordFailure(email, ip)
+	if err != nil {
+		return err
+	}
+
+	failures, err := app.models.LoginAttempts.FailuresForEmail(email, app.config.login.window)
+	if err != nil {
+		return err
+	}
+
+	if failures.Count < app.config.login.maxFailures {
+		return nil
+	}
+
+	lockedUntil := time.Now().Add(app.config.login.lockout)
+
+	// unregistered addresses are locked too, so that nobody can tell which addresses have
+	// accounts by seeing which ones get locked
+	if user == nil {
+		err = app.models.LoginAttempts.LockEmail(email, lockedUntil)
+		if err != nil {
+			return err
+		}
+
+		return app.models.LoginAttempts.ClearForEmail(email)
+	}
+
+	err = app.models.LoginAttempts.Lock(user.ID, lockedUntil)
+	if err != nil {
+		return err
+	}
+
+	// start counting again from scratch once the lockout is over
+	err = app.models.LoginAttempts.ClearForEmail(email)
+	if err != nil {
+		return err
+	}
+
+	app.logger.Warn("account locked after too many failed logins", "user_id", user.ID, "ip", ip)
+
+	app.background(func() {
+		lockoutData := map[string]any{
+			"userName":    user.Name,
+			"lockedUntil": lockedUntil.UTC().Format(time.RFC1123),
+			"ip":          ip,
+		}
+
+		err := app.mailer.Send(user.Email, "account_locked.tmpl", lockoutData)
+		if err != nil {
+			app.logger.Error("Failed to send account lockout notification.", "error", err.Error())
+		}
+	})
+
+	return nil
+}
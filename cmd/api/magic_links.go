@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"greenlight.twd.net/internal/data"
+	"greenlight.twd.net/internal/validator"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Magic links let users log in without a password. They ask for a link at
+// POST /v1/tokens/magic-link, which emails them a single-use login token, and exchange it at
+// POST /v1/tokens/authenticate/magic. Like password resets, neither endpoint lets on whether
+// an account exists, and both are rate limited per email address on top of the usual per-IP
+// limit, so that nobody can flood a mailbox or hammer one account from many addresses.
+
+// magicLinkTTL is how long a login token lasts
+const magicLinkTTL = 15 * time.Minute
+
+// emailLimiter rate limits requests per email address. Each address gets a burst of requests,
+// and then one more every interval. The limits are kept in the database, so they hold across
+// every instance of the API
+type emailLimiter struct {
+	model    data.EmailLimitModel
+	kind     string
+	interval time.Duration
+	burst    int
+}
+
+// newEmailLimiter returns an emailLimiter for the given kind of request, with the given
+// interval and burst
+func newEmailLimiter(model data.EmailLimitModel, kind string, interval time.Duration, burst int) *emailLimiter {
+	return &emailLimiter{
+		model:    model,
+		kind:     kind,
+		interval: interval,
+		burst:    burst,
+	}
+}
+
+// allow reports whether a request for the email address is allowed. Email addresses are
+// case-insensitive, like the users.email column
+func (l *emailLimiter) allow(email string) (bool, error) {
+	return l.model.Allow(l.kind, email, l.interval, l.burst)
+}
+
+// createMagicLinkHandler emails a login token to the user with the given email address. As with
+// password resets, we always send the same 202 Accepted response and do the work in the
+// background, so that neither the response nor its timing gives away whether the account exists
+func (app *application) createMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	allowed, err := app.magicLinkLimiters.send.allow(input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	app.background(func() {
+		user, err := app.models.Users.GetByEmail(input.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.Error("Failed to look up user for magic link.", "error", err.Error())
+			}
+			return
+		}
+
+		// we only trust the email addresses of activated accounts, and disabled accounts
+		// can't log in at all
+		if !user.Activated || user.Disabled {
+			return
+		}
+
+		// only the most recent link works
+		err = app.models.Tokens.DeleteAllForUser(data.ScopeLogin, user.ID)
+		if err != nil {
+			app.logger.Error("Failed to delete old login tokens.", "error", err.Error())
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, magicLinkTTL, data.ScopeLogin)
+		if err != nil {
+			app.logger.Error("Failed to create login token.", "error", err.Error())
+			return
+		}
+
+		tokenData := map[string]any{
+			"email":      user.Email,
+			"loginToken": token.Plaintext,
+		}
+
+		err = app.mailer.Send(user.Email, "magic_link.tmpl", tokenData)
+		if err != nil {
+			app.logger.Error("Failed to send magic link email.", "error", err.Error())
+		}
+	})
+
+	message := "if an account with this email address exists, an email will be sent to it containing a login link"
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createMagicAuthenticationTokenHandler exchanges a login token from a magic link for an
+// authentication token, like {"email": "alice@example.com", "token": "glt_lgn_..."}. The email
+// address is what the endpoint is rate limited by. Unknown addresses and bad tokens get the
+// same response, so it can't be used to find out which accounts exist
+func (app *application) createMagicAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email          string `json:"email"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidateToken(v, data.ScopeLogin, input.TokenPlaintext)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	allowed, err := app.magicLinkLimiters.redeem.allow(input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeLogin, input.TokenPlaintext)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user == nil || !strings.EqualFold(user.Email, input.Email) {
+		v.AddError("token", "invalid or expired login token")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// login tokens are single use
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeLogin, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
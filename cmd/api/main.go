@@ -5,8 +5,13 @@ import (
 	"database/sql"
 	"expvar"
 	"flag"
+	"fmt"
 	"greenlight.twd.net/internal/data"
+	"greenlight.twd.net/internal/jwt"
 	"greenlight.twd.net/internal/mailer"
+	"greenlight.twd.net/internal/oidc"
+	"greenlight.twd.net/internal/passwords"
+	"greenlight.twd.net/internal/storage"
 	"log/slog"
 	"os"
 	"runtime"
@@ -53,15 +58,103 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+
+	// storage holds the settings for where uploaded files (like movie posters) are kept.
+	// backend selects the storage implementation, currently only "local" is supported
+	storage struct {
+		backend        string
+		localDir       string
+		maxUploadBytes int64
+	}
+
+	// similar holds how often the precomputed "similar movies" scores are refreshed.
+	// An interval of zero disables the refresh job
+	similar struct {
+		refreshInterval time.Duration
+	}
+
+	// login holds the limits which protect the login endpoint against password guessing.
+	// Failed logins count for the length of the window. After maxFailures of them an
+	// account is locked for the lockout duration, and an IP address with maxIPFailures
+	// is turned away until its failures fall out of the window. backoff is the delay
+	// which is doubled for each failure after the first few
+	login struct {
+		maxFailures   int
+		maxIPFailures int
+		window        time.Duration
+		lockout       time.Duration
+		backoff       time.Duration
+	}
+
+	// password holds the policy for new passwords. minScore is the lowest strength score
+	// allowed, from 0 to 4, and breachedFile is the path of a file of SHA-1 hashes of
+	// breached passwords, which are rejected. No file means no breached password check
+	password struct {
+		minScore     int
+		breachedFile string
+	}
+
+	// tokens holds how long the tokens issued when logging in last. Authentication tokens
+	// are short-lived, and refresh tokens are exchanged for new ones before they expire.
+	// format is "opaque" for authentication tokens stored in the database, or "signed" for
+	// signed access tokens, which are signed with the keys in signingKeysFile. Without a
+	// file, a key is generated when the server starts. denylistSync is how often revoked
+	// signed tokens are reloaded from the database
+	tokens struct {
+		accessTTL       time.Duration
+		refreshTTL      time.Duration
+		format          string
+		signingKeysFile string
+		denylistSync    time.Duration
+	}
+
+	// magicLink holds the per-email rate limit for magic links. Each email address can ask
+	// for burst links, or redeem burst of them, and then one more every interval
+	magicLink struct {
+		burst    int
+		interval time.Duration
+	}
+
+	// oidc configures single sign-on with an OpenID Connect issuer, which is off unless
+	// issuer is set. redirectURL is our callback URL, as registered with the issuer. When
+	// autoProvision is on, users who log in without an account get one, with role, or the
+	// default role if that's empty
+	oidc struct {
+		issuer        string
+		clientID      string
+		clientSecret  string
+		redirectURL   string
+		autoProvision bool
+		role          string
+	}
+
+	// defaultRole is the role given to newly registered users. It must exist in the
+	// roles table, or be empty to register users without any role
+	defaultRole string
 }
 
 // declare a struct that will hold all dependencies for our application's HTTP handlers, helpers, and middleware.
 type application struct {
-	config config
-	logger *slog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config  config
+	logger  *slog.Logger
+	models  data.Models
+	mailer  mailer.Mailer
+	storage storage.Storage
+	wg      sync.WaitGroup
+
+	// signer signs and verifies signed access tokens, and denylist holds the ones which
+	// have been revoked. They're only used when signed tokens are turned on
+	signer   *jwt.KeySet
+	denylist *denylist
+
+	// magicLinkLimiters rate limit asking for and redeeming magic links per email address
+	magicLinkLimiters struct {
+		send   *emailLimiter
+		redeem *emailLimiter
+	}
+
+	// oidc is the OpenID Connect issuer users can log in with, or nil if there isn't one
+	oidc *oidc.Provider
 }
 
 func main() {
@@ -84,6 +177,35 @@ func main() {
 	flag.StringVar(&cfg.smtp.username, "smtp-username", os.Getenv("smtpUser"), "username for authenticating to SMTP server")
 	flag.StringVar(&cfg.smtp.password, "smtp-password", os.Getenv("smtpPass"), "password for authenticating to SMTP server")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.twd.net>", "SMTP sender")
+	flag.StringVar(&cfg.storage.backend, "storage-backend", "local", "Storage backend for uploaded files (local)")
+	flag.StringVar(&cfg.storage.localDir, "storage-local-dir", "./uploads", "Directory used by the local storage backend")
+	flag.Int64Var(&cfg.storage.maxUploadBytes, "upload-max-bytes", 10_485_760, "Maximum size of an uploaded image in bytes")
+	flag.StringVar(&cfg.defaultRole, "default-role", "viewer", "Role given to newly registered users (empty for none)")
+	flag.IntVar(&cfg.login.maxFailures, "login-max-failures", 10, "Failed logins before an account is locked")
+	flag.IntVar(&cfg.login.maxIPFailures, "login-max-ip-failures", 100, "Failed logins before an IP address is turned away")
+	flag.DurationVar(&cfg.login.window, "login-window", 15*time.Minute, "How long failed logins are counted for")
+	flag.DurationVar(&cfg.login.lockout, "login-lockout", 15*time.Minute, "How long an account is locked after too many failed logins")
+	flag.DurationVar(&cfg.login.backoff, "login-backoff", time.Second, "Initial delay between login attempts once backoff kicks in")
+
+	flag.DurationVar(&cfg.tokens.accessTTL, "access-token-ttl", 15*time.Minute, "How long authentication tokens last")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "How long refresh tokens last")
+	flag.StringVar(&cfg.tokens.format, "access-token-format", "opaque", "Kind of authentication token to issue (opaque|signed)")
+	flag.StringVar(&cfg.tokens.signingKeysFile, "signing-keys-file", "", "File of Ed25519 seeds for signing access tokens, current key first")
+	flag.DurationVar(&cfg.tokens.denylistSync, "denylist-sync-interval", 30*time.Second, "How often revoked signed tokens are synced from the database")
+
+	flag.IntVar(&cfg.magicLink.burst, "magic-link-burst", 3, "Magic link requests allowed at once per email address")
+	flag.DurationVar(&cfg.magicLink.interval, "magic-link-interval", 5*time.Minute, "How often each email address gets another magic link request")
+
+	flag.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "OpenID Connect issuer URL for single sign-on (empty to disable)")
+	flag.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", os.Getenv("oidcClientSecret"), "OpenID Connect client secret")
+	flag.StringVar(&cfg.oidc.redirectURL, "oidc-redirect-url", "http://localhost:4000/v1/auth/oidc/callback", "OpenID Connect callback URL registered with the issuer")
+	flag.BoolVar(&cfg.oidc.autoProvision, "oidc-auto-provision", false, "Create accounts for single sign-on users who don't have one")
+	flag.StringVar(&cfg.oidc.role, "oidc-role", "", "Role given to accounts created by single sign-on (empty for the default role)")
+
+	flag.IntVar(&cfg.password.minScore, "password-min-score", 2, "Lowest strength score (0-4) allowed for new passwords")
+	flag.StringVar(&cfg.password.breachedFile, "password-breached-file", "", "File of SHA-1 hashes of breached passwords to reject (optional)")
+	flag.DurationVar(&cfg.similar.refreshInterval, "similar-refresh-interval", 15*time.Minute, "How often to refresh similar movie scores (0 to disable)")
 
 	// Use the flag.Func() function to process the -cors-trusted-origins CLI flag.
 	// In this we use the strings.Fields() function to split the flag value into a
@@ -123,6 +245,76 @@ func main() {
 	// log that a connection pool has been established
 	logger.Info("Successfully established database connection")
 
+	// set up the storage backend used for uploaded files
+	store, err := openStorage(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	models := data.NewModels(db)
+
+	// load the breached password corpus up front, so that checking passwords never has to
+	// wait on the disk (or anything else)
+	policy := data.PasswordPolicy{MinScore: cfg.password.minScore}
+
+	if cfg.password.breachedFile != "" {
+		policy.Breached, err = passwords.LoadCorpus(cfg.password.breachedFile)
+		if err != nil {
+			logger.Error("failed to load breached passwords", "file", cfg.password.breachedFile, "error", err.Error())
+			os.Exit(1)
+		}
+		logger.Info("loaded breached passwords", "count", policy.Breached.Len())
+	}
+
+	data.DefaultPasswordPolicy = policy
+
+	// make sure the default role exists now, rather than when the first user registers
+	if cfg.defaultRole != "" {
+		_, err = models.Roles.GetByName(cfg.defaultRole)
+		if err != nil {
+			logger.Error("failed to load default role", "role", cfg.defaultRole, "error", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// signed access tokens need their keys, and the revocations made before we started
+	var signer *jwt.KeySet
+
+	switch cfg.tokens.format {
+	case "opaque":
+	case "signed":
+		signer, err = loadSigningKeys(cfg, logger)
+		if err != nil {
+			logger.Error("failed to load signing keys", "file", cfg.tokens.signingKeysFile, "error", err.Error())
+			os.Exit(1)
+		}
+	default:
+		logger.Error("unknown access token format", "format", cfg.tokens.format)
+		os.Exit(1)
+	}
+
+	// single sign-on needs the issuer's endpoints, and the role for new users, up front
+	var provider *oidc.Provider
+
+	if cfg.oidc.issuer != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		provider, err = oidc.Discover(ctx, cfg.oidc.issuer, nil)
+		cancel()
+		if err != nil {
+			logger.Error("failed to discover OIDC issuer", "issuer", cfg.oidc.issuer, "error", err.Error())
+			os.Exit(1)
+		}
+
+		if cfg.oidc.role != "" {
+			_, err = models.Roles.GetByName(cfg.oidc.role)
+			if err != nil {
+				logger.Error("failed to load OIDC role", "role", cfg.oidc.role, "error", err.Error())
+				os.Exit(1)
+			}
+		}
+	}
+
 	// Publish a new "version" variable in the expvar handler containing our application version
 	expvar.NewString("version").Set(version)
 
@@ -143,11 +335,53 @@ func main() {
 
 	// declare an instance of the app struct, containing the config and our logger
 	app := application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:   cfg,
+		logger:   logger,
+		models:   models,
+		mailer:   mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		storage:  store,
+		signer:   signer,
+		denylist: newDenylist(),
+		oidc:     provider,
+	}
+
+	app.magicLinkLimiters.send = newEmailLimiter(models.EmailLimits, "magic-link-send", cfg.magicLink.interval, cfg.magicLink.burst)
+	app.magicLinkLimiters.redeem = newEmailLimiter(models.EmailLimits, "magic-link-redeem", cfg.magicLink.interval, cfg.magicLink.burst)
+
+	// addresses whose limits have filled back up don't need remembering
+	app.runPeriodically("clean up email rate limits", cfg.magicLink.interval, app.models.EmailLimits.DeleteExpired)
+
+	if app.signedTokensEnabled() {
+		err = app.syncDenylist()
+		if err != nil {
+			logger.Error("failed to load token denylist", "error", err.Error())
+			os.Exit(1)
+		}
+
+		// revocations made by other instances only reach this one when it syncs, so this
+		// interval is how long a revoked signed token might still work here
+		app.runPeriodically("sync token denylist", cfg.tokens.denylistSync, app.syncDenylist)
+	}
+
+	// periodically recompute the similar movies materialized view, so that new and
+	// updated movies show up in recommendations
+	if cfg.similar.refreshInterval > 0 {
+		app.runPeriodically("refresh similar movies", cfg.similar.refreshInterval, app.models.Movies.RefreshSimilar)
+	}
+
+	// forget old failed logins and expired lockouts, which are only needed for the length of the window
+	app.runPeriodically("clean up login attempts", cfg.login.window, func() error {
+		return app.models.LoginAttempts.DeleteExpired(cfg.login.window)
+	})
+
+	// expired tokens are never accepted, so they can be thrown away
+	app.runPeriodically("clean up expired tokens", time.Hour, app.models.Tokens.DeleteExpired)
+
+	// single sign-on logins which were never finished leave their state behind
+	if app.oidcEnabled() {
+		app.runPeriodically("clean up OIDC states", time.Hour, app.models.OIDCStates.DeleteExpired)
 	}
+
 	err = app.server()
 	if err != nil {
 		logger.Error(err.Error())
@@ -155,6 +389,24 @@ func main() {
 	}
 }
 
+// loadSigningKeys returns the keys for signing access tokens. Without a keys file we generate
+// a key, which is fine for development, but tokens stop working when the server restarts and
+// other instances can't verify them
+func loadSigningKeys(cfg config, logger *slog.Logger) (*jwt.KeySet, error) {
+	if cfg.tokens.signingKeysFile != "" {
+		return jwt.LoadKeySet(cfg.tokens.signingKeysFile)
+	}
+
+	logger.Warn("no signing keys file given, generating a temporary signing key")
+
+	key, err := jwt.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return jwt.NewKeySet(key)
+}
+
 // openDB() helper function returns a sql.DB connection pool
 func openDB(cfg config) (*sql.DB, error) {
 	// use sql.Open() to create an empty connection pool, using the DSN from our
@@ -181,3 +433,13 @@ func openDB(cfg config) (*sql.DB, error) {
 	return db, nil
 
 }
+
+// openStorage() helper function returns the storage backend selected in the config
+func openStorage(cfg config) (storage.Storage, error) {
+	switch cfg.storage.backend {
+	case "local":
+		return storage.NewLocal(cfg.storage.localDir)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.storage.backend)
+	}
+}
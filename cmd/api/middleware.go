@@ -7,7 +7,6 @@ import (
 	"golang.org/x/time/rate"
 	"greenlight.twd.net/internal/data"
 	"greenlight.twd.net/internal/validator"
-	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -78,7 +77,7 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		// Extract the client's I.P address from the request
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip, err := app.remoteIP(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -120,11 +119,24 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// any caches that the response may vary based on the value of the Authorization
 		// header in the request.
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
 
 		// Retrieve the value of the Authorization header from the request.
 		// This will return the empty string "" if there is no such header found
 		authorizationHeader := r.Header.Get("Authorization")
 
+		// machine clients authenticate with an API key instead, either in the X-API-Key
+		// header or with the "ApiKey" scheme in the Authorization header
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			app.authenticateApiKey(w, r, next, key)
+			return
+		}
+
+		if key, ok := strings.CutPrefix(authorizationHeader, "ApiKey "); ok {
+			app.authenticateApiKey(w, r, next, key)
+			return
+		}
+
 		// If there is no Authorization header found, use the contextSetUser()
 		// helper that we just made to add the AnonymousUser to the request context.
 		// Then we call the next handler in the chain and return without executing
@@ -148,10 +160,31 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// extract the actual token
 		token := headerParts[1]
 
+		// signed access tokens are verified without touching the database
+		if app.signedTokensEnabled() && isSignedToken(token) {
+			claims, err := app.verifySignedToken(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			// the token only carries part of the user. Handlers which need the rest are
+			// wrapped with the loadUser middleware
+			user := &data.User{ID: claims.Subject, Activated: claims.Activated}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetToken(r, token)
+			r = app.contextSetClaims(r, claims)
+			r = app.contextSetPermissions(r, claims.Permissions)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// validator token to ensure it is in proper format
 		v := validator.New()
 
-		if data.ValidateToken(v, token); !v.Valid() {
+		if data.ValidateToken(v, data.ScopeAuthentication, token); !v.Valid() {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
@@ -170,15 +203,132 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// tokens are revoked when an account is disabled, but check anyway in case
+		// one was issued while the account was being disabled
+		if user.Disabled {
+			app.accountDisabledResponse(w, r)
+			return
+		}
+
+		// keep the session's last used time and client details up to date, so that
+		// users can see where they're logged in
+		ip, err := app.remoteIP(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.Tokens.Touch(token, r.UserAgent(), ip)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		// call the contextSetUser() helper to add the user information
-		// to the request context
+		// to the request context, along with the token they authenticated with
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 
 		// call the next HTTP handler in the chain
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticateApiKey is the part of authenticate which handles API keys. The request gets the
+// permissions of the key which its owner still has, so a key never outlives the permissions
+// of the user who made it
+func (app *application) authenticateApiKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	v := validator.New()
+
+	if data.ValidateApiKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidApiKeyResponse(w, r)
+		return
+	}
+
+	key, user, permissions, err := app.models.ApiKeys.GetForAuthentication(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidApiKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ip, err := app.remoteIP(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !key.AllowsIP(ip) {
+		app.invalidApiKeyResponse(w, r)
+		return
+	}
+
+	if user.Disabled {
+		app.accountDisabledResponse(w, r)
+		return
+	}
+
+	err = app.models.ApiKeys.Touch(key)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetApiKey(r, key)
+	r = app.contextSetPermissions(r, permissions.Intersect(key.Permissions))
+
+	next.ServeHTTP(w, r)
+}
+
+// rejectApiKeys turns away requests made with an API key, for endpoints which manage the
+// user's account and credentials. Otherwise a leaked key could be used to make more of them
+func (app *application) rejectApiKeys(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetApiKey(r) != nil {
+			app.apiKeyNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loadUser replaces the partial user from a signed access token with the full user record,
+// for handlers which need more than the user's ID and activation status
+func (app *application) loadUser(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetClaims(r) == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if user.Disabled {
+			app.accountDisabledResponse(w, r)
+			return
+		}
+
+		r = app.contextSetUser(r, user)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // requireActivatedUser checks that a user is both authenticated and activated
 func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -218,27 +368,54 @@ func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.Han
 // access the underlying resources. This wraps around the requireAuthenticatedUser and requireActivatedUser
 // middleware to perform three checks at once
 func (app *application) requirePermissions(code string, next http.HandlerFunc) http.HandlerFunc {
+	return app.requireAllPermissions([]string{code}, next)
+}
+
+// requireAnyPermissions works like requirePermissions, but lets the request through if the
+// user has at least one of the codes
+func (app *application) requireAnyPermissions(codes []string, next http.HandlerFunc) http.HandlerFunc {
+	return app.checkPermissions(func(permissions data.Permissions) bool {
+		return permissions.IncludeAny(codes...)
+	}, next)
+}
+
+// requireAllPermissions works like requirePermissions, but the user must have every one of the codes
+func (app *application) requireAllPermissions(codes []string, next http.HandlerFunc) http.HandlerFunc {
+	return app.checkPermissions(func(permissions data.Permissions) bool {
+		return permissions.IncludeAll(codes...)
+	}, next)
+}
+
+// checkPermissions does the work for the permission middleware. The allowed function decides
+// whether the user's permissions are enough to access the underlying resources
+func (app *application) checkPermissions(allowed func(data.Permissions) bool, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 
 		// retrieve user from context
 		user := app.contextGetUser(r)
 
-		// Get the slice of permissions for the user
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		// Get the slice of permissions for the user. Signed access tokens carry them already,
+		// so they're only looked up for other tokens
+		permissions, err := app.contextGetPermissions(r)
 		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
+			permissions, err = app.models.Permissions.GetAllForUser(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 		}
 		app.logger.Info("User permissions", "permissions", permissions)
 
-		// check if the slice includes required permissions. If it doesn't then we return
+		// check if the permissions are enough. If they aren't then we return
 		// 403 forbidden response
-		if !permissions.Include(code) {
+		if !allowed(permissions) {
 			app.notPermittedResponse(w, r)
 			return
 		}
 
-		// otherwise they have the required permissions so we call the next handler in the chain
+		// otherwise they have the required permissions so we call the next handler in the chain,
+		// passing the permissions along for any finer grained checks it wants to make
+		r = app.contextSetPermissions(r, permissions)
 		next.ServeHTTP(w, r)
 	}
 	return app.requireActivatedUser(fn)
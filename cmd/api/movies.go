@@ -8,15 +8,32 @@ import (
 	"net/http"
 )
 
+// canEditMovie reports whether the user may change or delete the movie. Anyone with
+// movies:write may edit every movie, but movies:write:own only covers the movies the
+// user added themselves
+func (app *application) canEditMovie(r *http.Request, movie *data.Movie) (bool, error) {
+	permissions, err := app.contextGetPermissions(r)
+	if err != nil {
+		return false, err
+	}
+
+	if permissions.Include("movies:write") {
+		return true, nil
+	}
+
+	return permissions.Include("movies:write:own") && movie.IsCreatedBy(app.contextGetUser(r).ID), nil
+}
+
 func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Request) {
 	// Declare an anonymous struct to hold the info we expect our clients to pass in the HTTP request body.
 	// Note the field names and types in the struct are a subset of the Movie struct we created earlier.
 	// This will be our *target decode destination*
 	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json:"genres"`
+		Title    string       `json:"title"`
+		Year     int32        `json:"year"`
+		Runtime  data.Runtime `json:"runtime"`
+		Genres   []string     `json:"genres"`
+		Synopsis string       `json:"synopsis"`
 	}
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -26,15 +43,20 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Copy values from input struct into Movie struct
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:     input.Title,
+		Year:      input.Year,
+		Runtime:   input.Runtime,
+		Genres:    input.Genres,
+		Synopsis:  input.Synopsis,
+		CreatedBy: &app.contextGetUser(r).ID,
 	}
 
 	// Init new Validator instance
 	v := validator.New()
 
+	// the response writes the runtime out in whichever format the client asked for
+	movie.RuntimeFormat = app.readRuntimeFormat(r, v)
+
 	// Call the ValidateMovie() method and return a response containing the errors if any of the checks fail
 	if data.ValidateMovie(v, movie); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
@@ -70,6 +92,14 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	v := validator.New()
+
+	runtimeFormat := app.readRuntimeFormat(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// call Get() method to fetch a record from the DB by its ID.
 	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound error
 	// in which case we send a 404 Not found response to the client
@@ -85,7 +115,25 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	// swap in the best matching translation for the client's preferred locales, if there is one
+	err = app.models.Translations.Localize([]*data.Movie{movie}, app.readLocales(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// the response now depends on the Accept-Language header, so let caches know. This is
+	// added to the Vary header the middleware has already set, rather than replacing it
+	w.Header().Add("Vary", "Accept-Language")
+
+	headers := make(http.Header)
+	if movie.Locale != "" {
+		headers.Set("Content-Language", movie.Locale)
+	}
+
+	movie.RuntimeFormat = runtimeFormat
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -115,16 +163,28 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// users who may only edit their own movies get the same 403 as users who can't edit at all
+	allowed, err := app.canEditMovie(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
 	// declare an input struct to hold the expected data from the client
 	// in order to be able to do partial updates against the below struct
 	// we are going to use pointers to the underlying types
 	// we do this because when using a pointer to the type we can check to see
 	// if a user supplied a value for it, if they did the value will not be nil
 	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
+		Title    *string       `json:"title"`
+		Year     *int32        `json:"year"`
+		Runtime  *data.Runtime `json:"runtime"`
+		Genres   []string      `json:"genres"`
+		Synopsis *string       `json:"synopsis"`
 	}
 	err = app.readJSON(w, r, &input)
 	if err != nil {
@@ -148,11 +208,17 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	if input.Genres != nil {
 		movie.Genres = input.Genres
 	}
+	if input.Synopsis != nil {
+		movie.Synopsis = *input.Synopsis
+	}
 
 	// run the validation checks
 	// Init new Validator instance
 	v := validator.New()
 
+	// the response writes the runtime out in whichever format the client asked for
+	movie.RuntimeFormat = app.readRuntimeFormat(r, v)
+
 	// Call the ValidateMovie() method and return a response containing the errors if any of the checks fail
 	if data.ValidateMovie(v, movie); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
@@ -186,8 +252,30 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// fetch the movie first, so that we can check who it belongs to
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	allowed, err := app.canEditMovie(r, movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !allowed {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
 	// Delete movie from DB and return a 404 error if the DB record is not found
-	err = app.models.Movies.Delete(id)
+	err = app.models.Movies.Delete(movie.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -208,8 +296,9 @@ func (app *application) listMovieHandler(w http.ResponseWriter, r *http.Request)
 	// to keep things consistent with our other handlers, we'll define an input struct
 	// to hold the expected values from the request query string
 	var input struct {
-		Title  string
-		Genres []string
+		Title      string
+		Genres     []string
+		Collection int
 		data.Filters
 	}
 
@@ -224,6 +313,12 @@ func (app *application) listMovieHandler(w http.ResponseWriter, r *http.Request)
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
 
+	// the collection filter restricts the list to the members of one collection,
+	// a value of 0 (the default) means no filtering
+	input.Collection = app.readInt(qs, "collection", 0, v)
+
+	runtimeFormat := app.readRuntimeFormat(r, v)
+
 	// get the page and page_size query string values as integers.
 	// notice we set the default page value to 1 and page_size to 20
 	// and that we pass the validator instance as the final argument here
@@ -235,6 +330,8 @@ func (app *application) listMovieHandler(w http.ResponseWriter, r *http.Request)
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
 
+	v.Check(input.Collection >= 0, "collection", "must be a positive integer")
+
 	// Execute validation checks on the Filters struct and send a response containing the errors
 	// if necessary
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
@@ -243,13 +340,94 @@ func (app *application) listMovieHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Call the GetAll() method to retrieve the movies, passing in the various filter parameters
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, int64(input.Collection), input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
 	}
 
+	err = app.models.Translations.Localize(movies, app.readLocales(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, movie := range movies {
+		movie.RuntimeFormat = runtimeFormat
+	}
+
+	w.Header().Add("Vary", "Accept-Language")
+
 	err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// showSimilarMoviesHandler returns a paginated list of the movies most similar to the
+// movie with the given ID, ranked by genre overlap and how close together they were released
+func (app *application) showSimilarMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	var filters data.Filters
+
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	// default to the most similar movies first
+	filters.Sort = app.readString(qs, "sort", "-score")
+	filters.SortSafelist = []string{"score", "title", "year", "-score", "-title", "-year"}
+
+	runtimeFormat := app.readRuntimeFormat(r, v)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// make sure the movie exists, so that we can tell the difference between an
+	// unknown movie and one which has nothing similar to it
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	similar, metadata, err := app.models.Movies.GetSimilar(movie.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	movies := make([]*data.Movie, len(similar))
+	for i := range similar {
+		movies[i] = similar[i].Movie
+		movies[i].RuntimeFormat = runtimeFormat
+	}
+
+	err = app.models.Translations.Localize(movies, app.readLocales(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept-Language")
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"similar": similar, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"greenlight.twd.net/internal/data"
+	"greenlight.twd.net/internal/oidc"
+	"greenlight.twd.net/internal/validator"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Single sign-on lets users log in with an external OpenID Connect issuer, like a company's
+// identity provider. GET /v1/auth/oidc/login sends the user to the issuer, which sends them
+// back to GET /v1/auth/oidc/callback with an authorization code. We exchange that for an ID
+// token, verify it against the issuer's keys, and log the user in as usual.
+//
+// The first time someone logs in, their identity with the issuer is linked to the user with
+// the same email address, as long as the issuer says it has verified that address. If there's
+// no such user and auto-provisioning is on, one is created with the configured role.
+// Afterwards the identity is found by the issuer's subject, so changing the email address on
+// either side doesn't break the link.
+
+// oidcStateTTL is how long a user has to log in with the issuer
+const oidcStateTTL = 10 * time.Minute
+
+// oidcBindingCookie is the cookie which ties a login to the browser which started it
+const oidcBindingCookie = "greenlight_oidc"
+
+// setOIDCBindingCookie sets or, with an empty value, clears the binding cookie. It's only sent
+// back to the callback, and isn't readable by scripts. It has to be SameSite=Lax rather than
+// Strict, as the issuer's redirect back to us is a cross-site navigation
+func (app *application) setOIDCBindingCookie(w http.ResponseWriter, value string) {
+	maxAge := int(oidcStateTTL.Seconds())
+	if value == "" {
+		maxAge = -1
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcBindingCookie,
+		Value:    value,
+		Path:     "/v1/auth/oidc/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(app.config.oidc.redirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// oidcEnabled reports whether single sign-on is configured
+func (app *application) oidcEnabled() bool {
+	return app.oidc != nil
+}
+
+// oidcConfig returns our client configuration for the issuer
+func (app *application) oidcConfig() oidc.Config {
+	return oidc.Config{
+		ClientID:     app.config.oidc.clientID,
+		ClientSecret: app.config.oidc.clientSecret,
+		RedirectURL:  app.config.oidc.redirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+	}
+}
+
+// oidcLoginHandler starts a single sign-on login. It remembers a random state, nonce and PKCE
+// code verifier for the login, sets the binding cookie, and redirects the user to the issuer
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.oidcEnabled() {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	state := &data.OIDCState{Expiry: time.Now().Add(oidcStateTTL)}
+
+	var err error
+
+	for _, value := range []*string{&state.State, &state.Binding, &state.Nonce, &state.Verifier} {
+		*value, err = oidc.RandomString()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.models.OIDCStates.Insert(state)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.setOIDCBindingCookie(w, state.Binding)
+
+	http.Redirect(w, r, app.oidc.AuthCodeURL(app.oidcConfig(), state.State, state.Nonce, state.Verifier), http.StatusFound)
+}
+
+// oidcCallbackHandler finishes a single sign-on login. The issuer redirects the user here with
+// the state we sent and an authorization code, or an error if the user didn't log in. It only
+// works in the browser which started the login, which has the binding cookie
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.oidcEnabled() {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	var binding string
+	if cookie, err := r.Cookie(oidcBindingCookie); err == nil {
+		binding = cookie.Value
+	}
+
+	// the cookie is only good for one attempt, whatever happens
+	app.setOIDCBindingCookie(w, "")
+
+	if issuerErr := qs.Get("error"); issuerErr != "" {
+		app.badRequestResponse(w, r, fmt.Errorf("login with the identity provider failed: %s", issuerErr))
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(qs.Get("state") != "", "state", "must be provided")
+	v.Check(qs.Get("code") != "", "code", "must be provided")
+	v.Check(binding != "", "state", "login must be finished in the browser it was started in")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// states are single use, which stops the same response from the issuer being replayed, and
+	// they're bound to the browser, which stops anyone else using a callback URL they've seen
+	state, err := app.models.OIDCStates.Consume(qs.Get("state"), binding)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired login, please start again")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	cfg := app.oidcConfig()
+
+	rawIDToken, err := app.oidc.Exchange(ctx, cfg, qs.Get("code"), state.Verifier)
+	if err != nil {
+		app.logger.Warn("OIDC code exchange failed.", "error", err.Error())
+		v.AddError("code", "invalid or expired authorization code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	claims, err := app.oidc.VerifyIDToken(ctx, cfg, rawIDToken, state.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrInvalidIDToken), errors.Is(err, oidc.ErrUnknownKey):
+			app.logger.Warn("OIDC ID token rejected.", "error", err.Error())
+			app.badRequestResponse(w, r, errors.New("the identity provider's ID token is not valid"))
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.oidcUser(claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, errOIDCNoAccount):
+			app.errorResponse(w, r, http.StatusForbidden, "there is no account for this identity, and accounts are not created automatically")
+		case errors.Is(err, errOIDCUnverifiedEmail):
+			app.errorResponse(w, r, http.StatusForbidden, "the identity provider has not verified this email address")
+		case errors.Is(err, errOIDCInactiveAccount):
+			app.inactiveAccountResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+var (
+	errOIDCNoAccount       = errors.New("no account for identity")
+	errOIDCUnverifiedEmail = errors.New("identity email not verified")
+	errOIDCInactiveAccount = errors.New("account for identity not activated")
+)
+
+// oidcUser returns the user an identity is linked to, linking it to the user with the same
+// email address, or a newly provisioned user, if this is the first time it's been used
+func (app *application) oidcUser(claims *oidc.Claims) (*data.User, error) {
+	userID, err := app.models.Identities.GetUserID(claims.Issuer, claims.Subject)
+	switch {
+	case err == nil:
+		return app.models.Users.Get(userID)
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, err
+	}
+
+	// we only link identities by email address when the issuer vouches for it, otherwise anyone
+	// who can sign up with the issuer could take over an account by claiming its address
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, errOIDCUnverifiedEmail
+	}
+
+	user, err := app.models.Users.GetByEmail(claims.Email)
+	switch {
+	case err == nil:
+		// an unactivated account's address was never confirmed to be its owner's, so it could
+		// have been registered by someone else to grab the identity when it first logs in
+		if !user.Activated {
+			return nil, errOIDCInactiveAccount
+		}
+	case errors.Is(err, data.ErrRecordNotFound):
+		if !app.config.oidc.autoProvision {
+			return nil, errOIDCNoAccount
+		}
+
+		user, err = app.provisionOIDCUser(claims)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	identity := &data.Identity{
+		UserID:  user.ID,
+		Issuer:  claims.Issuer,
+		Subject: claims.Subject,
+		Email:   claims.Email,
+	}
+
+	err = app.models.Identities.Insert(identity)
+	if err != nil && !errors.Is(err, data.ErrDuplicateIdentity) {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// provisionOIDCUser creates a user for an identity. The issuer has already verified their
+// email address, so they're activated straight away. They get a random password which nobody
+// knows, so until they reset it they can only log in with single sign-on or a magic link
+func (app *application) provisionOIDCUser(claims *oidc.Claims) (*data.User, error) {
+	name := claims.Name
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	user := &data.User{
+		Name:      name,
+		Email:     claims.Email,
+		Activated: true,
+	}
+
+	password, err := oidc.RandomString()
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+
+	v := validator.New()
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		return nil, fmt.Errorf("provisioning user for %s: invalid claims: %v", claims.Email, v.Errors)
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		return nil, err
+	}
+
+	role := app.oidcRole()
+	if role != "" {
+		err = app.models.Roles.AddForUser(user.ID, role)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	app.logger.Info("Provisioned user from OIDC identity.", "userID", user.ID, "issuer", claims.Issuer, "role", role)
+
+	return user, nil
+}
+
+// oidcRole returns the role given to users created by single sign-on, which is the default
+// role unless another one is configured
+func (app *application) oidcRole() string {
+	if app.config.oidc.role != "" {
+		return app.config.oidc.role
+	}
+
+	return app.config.defaultRole
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"greenlight.twd.net/internal/data"
+	"greenlight.twd.net/internal/validator"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// The handlers in this file manage permission codes and who has them. They're all guarded
+// by the permissions:admin permission code in routes.go, and every change is recorded as
+// an audit event
+
+// audit records an audit event for a change made by the user making the request. It's called
+// once the change has been made, so if the event can't be recorded we log the event itself
+// rather than tell the client that their change failed
+func (app *application) audit(r *http.Request, action, targetType, targetID string, details map[string]any) {
+	actorID := app.contextGetUser(r).ID
+
+	event := &data.AuditEvent{
+		ActorID:    &actorID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Details:    details,
+	}
+
+	err := app.models.Audit.Insert(event)
+	if err != nil {
+		app.logger.Error("Failed to record audit event.", "error", err.Error(), "actorID", actorID,
+			"action", action, "targetType", targetType, "targetID", targetID, "details", details)
+	}
+}
+
+// readPermission looks up the permission identified by the :id URL parameter
+func (app *application) readPermission(r *http.Request) (*data.Permission, error) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return app.models.Permissions.Get(id)
+}
+
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	permissions, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code        string `json:"code"`
+		Description string `json:"description"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	permission := &data.Permission{
+		Code:        input.Code,
+		Description: input.Description,
+	}
+
+	v := validator.New()
+
+	if data.ValidatePermission(v, permission); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Permissions.Insert(permission)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateCode):
+			v.AddError("code", "a permission with this code already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditPermissionCreate, "permission", permission.Code, map[string]any{"description": permission.Description})
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/permissions/%d", permission.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"permission": permission}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updatePermissionHandler changes the description of a permission. The code itself can't be changed
+func (app *application) updatePermissionHandler(w http.ResponseWriter, r *http.Request) {
+	permission, err := app.readPermission(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Description *string `json:"description"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Description != nil {
+		permission.Description = *input.Description
+	}
+
+	v := validator.New()
+
+	if data.ValidatePermission(v, permission); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Permissions.Update(permission)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, data.AuditPermissionUpdate, "permission", permission.Code, map[string]any{"description": permission.Description})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permission": permission}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deletePermissionHandler removes a permission code, revoking it from everyone who has it.
+// Neither permissions:admin nor the "*" wildcard, which covers it, can be deleted, as nobody might
+// be able to manage permissions afterwards
+func (app *application) deletePermissionHandler(w http.ResponseWriter, r *http.Request) {
+	permission, err := app.readPermission(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if permission.Code == "permissions:admin" || permission.Code == "*" {
+		app.failedValidationResponse(w, r, map[string]string{"code": fmt.Sprintf("the %s permission cannot be deleted", permission.Code)})
+		return
+	}
+
+	// signed access tokens carry the codes their users had when they were issued, so everyone
+	// with this one needs a new token. Who had it has to be looked up before it's gone
+	userIDs, err := app.models.Permissions.GetUserIDs(permission.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Permissions.Delete(permission.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.revokeSignedTokensForUsers(userIDs)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditPermissionDelete, "permission", permission.Code, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "permission successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listUserPermissionsHandler returns a user's effective permission codes, which includes the
+// codes from their roles, along with the codes which have been granted to them directly
+func (app *application) listUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.readUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	direct, err := app.models.Permissions.GetDirectForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// send empty lists rather than null when the user has no permissions
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+	if direct == nil {
+		direct = data.Permissions{}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions, "direct": direct}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// grantUserPermissionsHandler grants one or more permission codes to a user, like
+// {"codes": ["movies:write"]}. Granting a code the user already has is a no-op
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.readUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Codes []string `json:"codes"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Codes) > 0, "codes", "must contain at least 1 permission code")
+	v.Check(validator.Unique(input.Codes), "codes", "must not contain duplicate values")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// AddForUser silently skips codes which don't exist, so check them first
+	defined, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, code := range input.Codes {
+		exists := slices.ContainsFunc(defined, func(p *data.Permission) bool {
+			return p.Code == code
+		})
+		if !exists {
+			v.AddError("codes", fmt.Sprintf("%s is not a known permission code", code))
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.models.Permissions.AddForUser(user.ID, input.Codes...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditPermissionGrant, "user", strconv.FormatInt(user.ID, 10), map[string]any{"codes": input.Codes})
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeUserPermissionHandler revokes a directly granted permission code from a user, like
+// DELETE /v1/users/1/permissions/movies:write. Administrators can't revoke their own
+// permissions:admin code, so that there's always somebody left who can manage permissions
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.readUser(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	if code == "permissions:admin" && user.ID == app.contextGetUser(r).ID {
+		app.selfActionResponse(w, r)
+		return
+	}
+
+	// only direct grants can be revoked here. Codes which come from one of the user's
+	// roles have to be removed by revoking the role instead, and codes covered by a
+	// wildcard by revoking the wildcard
+	direct, err := app.models.Permissions.GetDirectForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// compare codes exactly here, as a wildcard grant doesn't mean the exact code was granted
+	if !slices.Contains(direct, code) {
+		effective, err := app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if effective.Include(code) {
+			app.failedValidationResponse(w, r, map[string]string{"code": "is not granted directly, it comes from a role or a wildcard code"})
+			return
+		}
+
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Permissions.RemoveForUser(user.ID, code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// signed access tokens carry the user's permissions, so revoke them. The user's next
+	// refresh gets a token without the revoked permission
+	err = app.revokeSignedTokens(user.ID, 0)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, data.AuditPermissionRevoke, "user", strconv.FormatInt(user.ID, 10), map[string]any{"codes": []string{code}})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "permission successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -11,27 +11,130 @@ func (app *application) routes() http.Handler {
 	//init a new httprouter instance
 	router := httprouter.New()
 
+	// httprouter doesn't allow a named parameter to share a path segment with a static
+	// route (/v1/movies/by-external/... would clash with /v1/movies/:id/poster). Routes
+	// like that are registered on a second fallback router instead, which we make the
+	// main router's NotFound handler, so it gets a go at any request the main router can't match
+	fallback := httprouter.New()
+
 	// Convert the notFoundResponse() helper to a http.Handler using the http.HandlerFunc() adapter
 	// and then set it as the custom error handler for 404 not found
-	router.NotFound = http.HandlerFunc(app.notFoundResponse)
+	fallback.NotFound = http.HandlerFunc(app.notFoundResponse)
+	router.NotFound = fallback
 
 	// Likewise, convert the methodNotAllowedResonse() helper to a http.Handler
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+	fallback.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
 	//register relevant methods, URL patterns, and handler funcs
 	// the /v1/movies* endpoints are all wrapped with a custom middleware
 	// func that protects the movies endpoints from being accessed by anonymous users
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermissions("movies:write", app.createMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/.well-known/keys", app.keysHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermissions("movies:write:own", app.createMovieHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermissions("movies:read", app.showMovieHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermissions("movies:read", app.listMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermissions("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermissions("movies:write", app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermissions("movies:write:own", app.updateMovieHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermissions("movies:write:own", app.deleteMovieHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id/poster", app.requirePermissions("movies:write", app.uploadMoviePosterHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/poster", app.requirePermissions("movies:read", app.showMoviePosterHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id/backdrop", app.requirePermissions("movies:write", app.uploadMovieBackdropHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/backdrop", app.requirePermissions("movies:read", app.showMovieBackdropHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/similar", app.requirePermissions("movies:read", app.showSimilarMoviesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/translations", app.requirePermissions("movies:read", app.listMovieTranslationsHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id/translations/:locale", app.requirePermissions("movies:write", app.putMovieTranslationHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id/translations/:locale", app.requirePermissions("movies:write", app.deleteMovieTranslationHandler))
+
+	// series, seasons and episodes are part of the same catalog as movies, so they're
+	// protected by the same movies:read and movies:write permission codes
+	router.HandlerFunc(http.MethodPost, "/v1/series", app.requirePermissions("movies:write", app.createSeriesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/series", app.requirePermissions("movies:read", app.listSeriesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/series/:id", app.requirePermissions("movies:read", app.showSeriesHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/series/:id", app.requirePermissions("movies:write", app.updateSeriesHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/series/:id", app.requirePermissions("movies:write", app.deleteSeriesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/series/:id/seasons", app.requirePermissions("movies:write", app.createSeasonHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/series/:id/seasons", app.requirePermissions("movies:read", app.listSeasonsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/series/:id/seasons/:season", app.requirePermissions("movies:read", app.showSeasonHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/series/:id/seasons/:season", app.requirePermissions("movies:write", app.updateSeasonHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/series/:id/seasons/:season", app.requirePermissions("movies:write", app.deleteSeasonHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/series/:id/seasons/:season/episodes", app.requirePermissions("movies:write", app.createEpisodeHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/series/:id/seasons/:season/episodes", app.requirePermissions("movies:read", app.listEpisodesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/series/:id/seasons/:season/episodes/:episode", app.requirePermissions("movies:read", app.showEpisodeHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/series/:id/seasons/:season/episodes/:episode", app.requirePermissions("movies:write", app.updateEpisodeHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/series/:id/seasons/:season/episodes/:episode", app.requirePermissions("movies:write", app.deleteEpisodeHandler))
+
+	// collections are managed with movies:write, but editing or deleting somebody else's
+	// curated list also needs collections:admin, which the handlers check themselves
+	router.HandlerFunc(http.MethodPost, "/v1/collections", app.requirePermissions("movies:write", app.createCollectionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/collections", app.requirePermissions("movies:read", app.listCollectionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/collections/:id", app.requirePermissions("movies:read", app.showCollectionHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/collections/:id", app.requirePermissions("movies:write", app.updateCollectionHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/collections/:id", app.requirePermissions("movies:write", app.deleteCollectionHandler))
+
+	fallback.HandlerFunc(http.MethodGet, "/v1/movies/by-external/:source/:value", app.requirePermissions("movies:read", app.showMovieByExternalIDHandler))
+	fallback.HandlerFunc(http.MethodPut, "/v1/movies/by-external/:source/:value", app.requirePermissions("movies:write", app.upsertMovieByExternalIDHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/search", app.requirePermissions("movies:read", app.searchHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireActivatedUser(app.loadUser(app.showCurrentUserHandler)))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireActivatedUser(app.rejectApiKeys(app.loadUser(app.updateCurrentUserHandler))))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.rejectApiKeys(app.listSessionsHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireAuthenticatedUser(app.rejectApiKeys(app.deleteSessionHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/2fa", app.requireActivatedUser(app.rejectApiKeys(app.loadUser(app.showTwoFactorHandler))))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/2fa", app.requireActivatedUser(app.rejectApiKeys(app.loadUser(app.enrollTwoFactorHandler))))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/2fa", app.requireActivatedUser(app.rejectApiKeys(app.loadUser(app.disableTwoFactorHandler))))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/2fa/confirm", app.requireActivatedUser(app.rejectApiKeys(app.loadUser(app.confirmTwoFactorHandler))))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/2fa/recovery-codes", app.requireActivatedUser(app.rejectApiKeys(app.loadUser(app.regenerateRecoveryCodesHandler))))
+
+	// API keys can't be used to manage the account they belong to, or to make more API keys
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireActivatedUser(app.rejectApiKeys(app.listApiKeysHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireActivatedUser(app.rejectApiKeys(app.createApiKeyHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireActivatedUser(app.rejectApiKeys(app.deleteApiKeyHandler)))
+
+	// the admin user management endpoints. /v1/users/:id would clash with static routes
+	// like /v1/users/me, so everything with an :id goes on the fallback router
+	router.HandlerFunc(http.MethodGet, "/v1/users", app.requirePermissions("users:admin", app.listUsersHandler))
+	fallback.HandlerFunc(http.MethodGet, "/v1/users/:id", app.requireAnyPermissions([]string{"users:admin", "permissions:admin"}, app.showUserHandler))
+	fallback.HandlerFunc(http.MethodDelete, "/v1/users/:id", app.requirePermissions("users:admin", app.deleteUserHandler))
+	fallback.HandlerFunc(http.MethodPost, "/v1/users/:id/deactivate", app.requirePermissions("users:admin", app.deactivateUserHandler))
+	fallback.HandlerFunc(http.MethodPost, "/v1/users/:id/reactivate", app.requirePermissions("users:admin", app.reactivateUserHandler))
+	fallback.HandlerFunc(http.MethodDelete, "/v1/users/:id/tokens", app.requirePermissions("users:admin", app.revokeUserTokensHandler))
+	fallback.HandlerFunc(http.MethodGet, "/v1/users/:id/lockout", app.requirePermissions("users:admin", app.showUserLockoutHandler))
+	fallback.HandlerFunc(http.MethodDelete, "/v1/users/:id/lockout", app.requirePermissions("users:admin", app.unlockUserHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/permissions", app.requirePermissions("permissions:admin", app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/permissions", app.requirePermissions("permissions:admin", app.createPermissionHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/permissions/:id", app.requirePermissions("permissions:admin", app.updatePermissionHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/permissions/:id", app.requirePermissions("permissions:admin", app.deletePermissionHandler))
+	fallback.HandlerFunc(http.MethodGet, "/v1/users/:id/permissions", app.requirePermissions("permissions:admin", app.listUserPermissionsHandler))
+	fallback.HandlerFunc(http.MethodPost, "/v1/users/:id/permissions", app.requirePermissions("permissions:admin", app.grantUserPermissionsHandler))
+	fallback.HandlerFunc(http.MethodDelete, "/v1/users/:id/permissions/:code", app.requirePermissions("permissions:admin", app.revokeUserPermissionHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/roles", app.requirePermissions("permissions:admin", app.listRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/roles", app.requirePermissions("permissions:admin", app.createRoleHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/roles/:id", app.requirePermissions("permissions:admin", app.updateRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/roles/:id", app.requirePermissions("permissions:admin", app.deleteRoleHandler))
+	fallback.HandlerFunc(http.MethodGet, "/v1/users/:id/roles", app.requirePermissions("permissions:admin", app.listUserRolesHandler))
+	fallback.HandlerFunc(http.MethodPost, "/v1/users/:id/roles", app.requirePermissions("permissions:admin", app.grantUserRolesHandler))
+	fallback.HandlerFunc(http.MethodDelete, "/v1/users/:id/roles/:role", app.requirePermissions("permissions:admin", app.revokeUserRoleHandler))
+
 	router.HandlerFunc(http.MethodPost, "/v1/token", app.generateTokenHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authenticate", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/2fa", app.createTwoFactorAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", app.createMagicLinkHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authenticate/magic", app.createMagicAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.createRefreshedTokensHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.rejectApiKeys(app.deleteAuthenticationTokenHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+
+	// single sign-on with an OpenID Connect issuer, which 404s unless one is configured
+	router.HandlerFunc(http.MethodGet, "/v1/auth/oidc/login", app.oidcLoginHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/auth/oidc/callback", app.oidcCallbackHandler)
+
 	router.Handler(http.MethodGet, "/v1/metrics", expvar.Handler())
 	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
 }
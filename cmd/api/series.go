@@ -0,0 +1,708 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"greenlight.twd.net/internal/data"
+	"greenlight.twd.net/internal/validator"
+	"net/http"
+)
+
+func (app *application) createSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title  string   `json:"title"`
+		Year   int32    `json:"year"`
+		Genres []string `json:"genres"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	series := &data.Series{
+		Title:  input.Title,
+		Year:   input.Year,
+		Genres: input.Genres,
+	}
+
+	v := validator.New()
+
+	if data.ValidateSeries(v, series); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Series.Insert(series)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/series/%d", series.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"series": series}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showSeriesHandler returns a series along with a list of its seasons
+func (app *application) showSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	series, err := app.models.Series.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	seasons, err := app.models.Seasons.GetAllForSeries(series.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"series": series, "seasons": seasons}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	series, err := app.models.Series.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// as with movies, we use pointers so that we can support partial updates
+	var input struct {
+		Title  *string  `json:"title"`
+		Year   *int32   `json:"year"`
+		Genres []string `json:"genres"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Title != nil {
+		series.Title = *input.Title
+	}
+	if input.Year != nil {
+		series.Year = *input.Year
+	}
+	if input.Genres != nil {
+		series.Genres = input.Genres
+	}
+
+	v := validator.New()
+
+	if data.ValidateSeries(v, series); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// moving the series' year later mustn't leave any of its seasons starting before it
+	if input.Year != nil {
+		seasons, err := app.models.Seasons.GetAllForSeries(series.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		for _, season := range seasons {
+			v.Check(series.Year <= season.Year, "year", "year cannot be after the series' earliest season")
+		}
+
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	err = app.models.Series.Update(series)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"series": series}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Series.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "series successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listSeriesHandler supports the same title, genres, paging and sort parameters as listMovieHandler
+func (app *application) listSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title  string
+		Genres []string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Title = app.readString(qs, "title", "")
+	input.Genres = app.readCSV(qs, "genres", []string{})
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "title", "year", "-id", "-title", "-year"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	series, metadata, err := app.models.Series.GetAll(input.Title, input.Genres, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"series": series, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readSeason looks up the season identified by the :id and :season URL parameters.
+// If either parameter is invalid we return data.ErrRecordNotFound, so that callers can
+// treat a malformed URL and a missing season the same way
+func (app *application) readSeason(r *http.Request) (*data.Season, error) {
+	seriesID, err := app.readIDParam(r)
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	number, err := app.readNumberParam(r, "season")
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return app.models.Seasons.GetByNumber(seriesID, number)
+}
+
+func (app *application) createSeasonHandler(w http.ResponseWriter, r *http.Request) {
+	seriesID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// make sure the parent series exists before we try to add a season to it
+	series, err := app.models.Series.Get(seriesID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Number int32  `json:"number"`
+		Title  string `json:"title"`
+		Year   int32  `json:"year"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	season := &data.Season{
+		SeriesID: series.ID,
+		Number:   input.Number,
+		Title:    input.Title,
+		Year:     input.Year,
+	}
+
+	v := validator.New()
+
+	// a season can't have aired before the series itself started
+	v.Check(season.Year >= series.Year, "year", "year cannot be before the series started")
+
+	if data.ValidateSeason(v, season); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Seasons.Insert(season)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateNumber):
+			v.AddError("number", "a season with this number already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/series/%d/seasons/%d", series.ID, season.Number))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"season": season}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listSeasonsHandler(w http.ResponseWriter, r *http.Request) {
+	seriesID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	series, err := app.models.Series.Get(seriesID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	seasons, err := app.models.Seasons.GetAllForSeries(series.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"seasons": seasons}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showSeasonHandler returns a season along with a list of its episodes
+func (app *application) showSeasonHandler(w http.ResponseWriter, r *http.Request) {
+	season, err := app.readSeason(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	runtimeFormat := app.readRuntimeFormat(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	episodes, err := app.models.Episodes.GetAllForSeason(season.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, episode := range episodes {
+		episode.RuntimeFormat = runtimeFormat
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"season": season, "episodes": episodes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateSeasonHandler(w http.ResponseWriter, r *http.Request) {
+	season, err := app.readSeason(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Number *int32  `json:"number"`
+		Title  *string `json:"title"`
+		Year   *int32  `json:"year"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Number != nil {
+		season.Number = *input.Number
+	}
+	if input.Title != nil {
+		season.Title = *input.Title
+	}
+	if input.Year != nil {
+		season.Year = *input.Year
+	}
+
+	// the season was found through the series, so it exists unless it was deleted just now
+	series, err := app.models.Series.Get(season.SeriesID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	// a season can't have aired before the series itself started
+	v.Check(season.Year >= series.Year, "year", "year cannot be before the series started")
+
+	if data.ValidateSeason(v, season); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Seasons.Update(season)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateNumber):
+			v.AddError("number", "a season with this number already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"season": season}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteSeasonHandler(w http.ResponseWriter, r *http.Request) {
+	season, err := app.readSeason(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Seasons.Delete(season.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "season successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readEpisode looks up the episode identified by the :id, :season and :episode URL parameters
+func (app *application) readEpisode(r *http.Request) (*data.Episode, error) {
+	season, err := app.readSeason(r)
+	if err != nil {
+		return nil, err
+	}
+
+	number, err := app.readNumberParam(r, "episode")
+	if err != nil {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return app.models.Episodes.GetByNumber(season.ID, number)
+}
+
+func (app *application) createEpisodeHandler(w http.ResponseWriter, r *http.Request) {
+	season, err := app.readSeason(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Number  int32        `json:"number"`
+		Title   string       `json:"title"`
+		Runtime data.Runtime `json:"runtime"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	episode := &data.Episode{
+		SeasonID: season.ID,
+		Number:   input.Number,
+		Title:    input.Title,
+		Runtime:  input.Runtime,
+	}
+
+	v := validator.New()
+
+	episode.RuntimeFormat = app.readRuntimeFormat(r, v)
+
+	if data.ValidateEpisode(v, episode); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Episodes.Insert(episode)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateNumber):
+			v.AddError("number", "an episode with this number already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/series/%d/seasons/%d/episodes/%d", season.SeriesID, season.Number, episode.Number))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"episode": episode}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listEpisodesHandler(w http.ResponseWriter, r *http.Request) {
+	season, err := app.readSeason(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	runtimeFormat := app.readRuntimeFormat(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	episodes, err := app.models.Episodes.GetAllForSeason(season.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, episode := range episodes {
+		episode.RuntimeFormat = runtimeFormat
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"episodes": episodes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showEpisodeHandler(w http.ResponseWriter, r *http.Request) {
+	episode, err := app.readEpisode(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+
+	episode.RuntimeFormat = app.readRuntimeFormat(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"episode": episode}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateEpisodeHandler(w http.ResponseWriter, r *http.Request) {
+	episode, err := app.readEpisode(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Number  *int32        `json:"number"`
+		Title   *string       `json:"title"`
+		Runtime *data.Runtime `json:"runtime"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Number != nil {
+		episode.Number = *input.Number
+	}
+	if input.Title != nil {
+		episode.Title = *input.Title
+	}
+	if input.Runtime != nil {
+		episode.Runtime = *input.Runtime
+	}
+
+	v := validator.New()
+
+	episode.RuntimeFormat = app.readRuntimeFormat(r, v)
+
+	if data.ValidateEpisode(v, episode); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Episodes.Update(episode)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateNumber):
+			v.AddError("number", "an episode with this number already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"episode": episode}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteEpisodeHandler(w http.ResponseWriter, r *http.Request) {
+	episode, err := app.readEpisode(r)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Episodes.Delete(episode.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "episode successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
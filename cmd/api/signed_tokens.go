@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"greenlight.twd.net/internal/data"
+	"greenlight.twd.net/internal/jwt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signed access tokens are an alternative to looking the authentication token and the user's
+// permissions up in the database on every request. When cfg.tokens.format is "signed", logging
+// in issues a JWT carrying the user's ID, activation status and permission codes, which the
+// authenticate middleware verifies locally. Refresh tokens are still stored in the database,
+// and each refresh issues a new signed token with the user's current permissions.
+//
+// Signed tokens can't be deleted, so they're revoked by adding an entry to a denylist instead.
+// Entries only need to last as long as the access token TTL, so the list stays short, and
+// every instance keeps a copy in memory which is synced from the database periodically.
+
+// accessClaims are the claims in a signed access token. Session is the family of the refresh
+// token it was issued with, so that a session can be revoked as a whole
+type accessClaims struct {
+	Subject     int64    `json:"sub"`
+	IssuedAt    int64    `json:"iat"`
+	Expiry      int64    `json:"exp"`
+	Session     int64    `json:"sid"`
+	Activated   bool     `json:"act"`
+	Permissions []string `json:"perms"`
+}
+
+// signedTokensEnabled reports whether logging in issues signed access tokens
+func (app *application) signedTokensEnabled() bool {
+	return app.config.tokens.format == "signed"
+}
+
+// isSignedToken reports whether a bearer token looks like a JWT rather than one of our
+// plaintext tokens, which never contain dots
+func isSignedToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// issueSignedToken signs an access token for a user in the given session. It's returned as a
+// data.Token so that clients get the same {"token", "expiry"} object as for opaque tokens
+func (app *application) issueSignedToken(user *data.User, session int64) (*data.Token, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.tokens.accessTTL)
+
+	claims := accessClaims{
+		Subject:     user.ID,
+		IssuedAt:    now.Unix(),
+		Expiry:      expiry.Unix(),
+		Session:     session,
+		Activated:   user.Activated,
+		Permissions: permissions,
+	}
+
+	plaintext, err := app.signer.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{
+		Plaintext: plaintext,
+		UserID:    user.ID,
+		Expiry:    time.Unix(claims.Expiry, 0),
+		Scope:     data.ScopeAuthentication,
+		Family:    session,
+	}, nil
+}
+
+// verifySignedToken checks a signed access token and that it hasn't been revoked, returning
+// its claims. Errors from the jwt package mean the token isn't valid
+func (app *application) verifySignedToken(token string) (*accessClaims, error) {
+	var claims accessClaims
+
+	err := app.signer.Verify(token, &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if app.denylist.revoked(claims.Subject, claims.Session, time.Unix(claims.IssuedAt, 0)) {
+		return nil, jwt.ErrInvalidToken
+	}
+
+	return &claims, nil
+}
+
+// revokeSignedTokens adds a denylist entry revoking the signed access tokens issued to a user
+// up to now, or only those for one session if session isn't zero. It does nothing unless
+// signed tokens are turned on
+func (app *application) revokeSignedTokens(userID, session int64) error {
+	if !app.signedTokensEnabled() {
+		return nil
+	}
+
+	now := time.Now().Truncate(time.Second)
+
+	entry := &data.DenylistEntry{
+		UserID:       userID,
+		Session:      session,
+		IssuedBefore: now,
+		Expiry:       now.Add(app.config.tokens.accessTTL + time.Second),
+	}
+
+	err := app.models.Denylist.Insert(entry)
+	if err != nil {
+		return err
+	}
+
+	// other instances pick the entry up next time they sync, but this one can use it straight away
+	app.denylist.add(entry)
+
+	return nil
+}
+
+// revokeSignedTokensForUsers revokes every signed access token issued to the users up to now,
+// for changes which affect lots of users at once, like changing the permission codes in a role.
+// It does nothing unless signed tokens are turned on
+func (app *application) revokeSignedTokensForUsers(userIDs []int64) error {
+	if !app.signedTokensEnabled() {
+		return nil
+	}
+
+	now := time.Now().Truncate(time.Second)
+	expiry := now.Add(app.config.tokens.accessTTL + time.Second)
+
+	err := app.models.Denylist.InsertForUsers(userIDs, now, expiry)
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		app.denylist.add(&data.DenylistEntry{UserID: userID, IssuedBefore: now, Expiry: expiry})
+	}
+
+	return nil
+}
+
+// currentSession returns the session the request was authenticated with, which is the
+// family of its authentication token. It's zero if the token has been deleted since
+func (app *application) currentSession(r *http.Request) (int64, error) {
+	if claims := app.contextGetClaims(r); claims != nil {
+		return claims.Session, nil
+	}
+
+	family, err := app.models.Tokens.GetFamily(data.ScopeAuthentication, app.contextGetToken(r))
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return 0, nil
+	}
+
+	return family, err
+}
+
+// keysHandler publishes the public keys signed access tokens are verified with, in JWKS form,
+// so that other services can verify them too. The list is empty unless signed tokens are on
+func (app *application) keysHandler(w http.ResponseWriter, r *http.Request) {
+	keys := []jwt.JWK{}
+
+	if app.signedTokensEnabled() {
+		keys = app.signer.JWKS()
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// denylist is the in-memory copy of the token denylist, which is checked on every request
+// made with a signed token
+type denylist struct {
+	mu      sync.RWMutex
+	entries map[int64][]*data.DenylistEntry
+}
+
+// newDenylist returns an empty denylist
+func newDenylist() *denylist {
+	return &denylist{entries: make(map[int64][]*data.DenylistEntry)}
+}
+
+// add adds an entry to the denylist
+func (d *denylist) add(entry *data.DenylistEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.entries[entry.UserID] = append(d.entries[entry.UserID], entry)
+}
+
+// replace swaps the contents of the denylist for the given entries
+func (d *denylist) replace(entries []*data.DenylistEntry) {
+	byUser := make(map[int64][]*data.DenylistEntry)
+
+	for _, entry := range entries {
+		byUser[entry.UserID] = append(byUser[entry.UserID], entry)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.entries = byUser
+}
+
+// revoked reports whether a token issued to userID for session at issuedAt has been revoked
+func (d *denylist) revoked(userID, session int64, issuedAt time.Time) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, entry := range d.entries[userID] {
+		if entry.Matches(userID, session, issuedAt) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// syncDenylist reloads the in-memory denylist from the database, which picks up entries added
+// by other instances and drops expired ones
+func (app *application) syncDenylist() error {
+	err := app.models.Denylist.DeleteExpired()
+	if err != nil {
+		return err
+	}
+
+	entries, err := app.models.Denylist.GetActive()
+	if err != nil {
+		return err
+	}
+
+	app.denylist.replace(entries)
+
+	return nil
+}
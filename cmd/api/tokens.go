@@ -76,6 +76,35 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	ip, err := app.remoteIP(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// make the client back off if there have been too many failed logins recently,
+	// either for this email address or from this IP address
+	retryAfter, err := app.loginRetryAfter(input.Email, ip)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if retryAfter > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	// an unregistered address which has been locked out gets the same response as a locked account
+	emailLockout, err := app.models.LoginAttempts.GetEmailLock(input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if emailLockout != nil {
+		app.accountLockedResponse(w, r, emailLockout)
+		return
+	}
+
 	// Lookup user record by email provided in the client request
 	// if no matching user was found, then we call the app.invalidCredentialResponse helper
 	// to send a 401 unauthorized response to the client
@@ -83,6 +112,11 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.recordLoginFailure(input.Email, ip, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 			app.invalidCredentialResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -90,6 +124,18 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// a locked account can't be logged in to, even with the right password, so there's
+	// no point checking it
+	lockout, err := app.models.LoginAttempts.GetLock(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if lockout != nil {
+		app.accountLockedResponse(w, r, lockout)
+		return
+	}
+
 	// check if the provided password matches the actual password for the user
 	matches, err := user.Password.Matches(input.Password)
 	if err != nil {
@@ -97,20 +143,399 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	// if passwords don't match, we then call the invalidCredentialResponse helper
+	// if passwords don't match, we record the failure and then call the invalidCredentialResponse helper
 	if !matches {
+		err = app.recordLoginFailure(input.Email, ip, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidCredentialResponse(w, r)
+		return
+	}
+
+	// this is the only time we have the plaintext password, so it's our chance to upgrade a
+	// hash made by an old algorithm or with outdated parameters. A failure here shouldn't stop
+	// the user logging in, as the old hash still works
+	if user.Password.NeedsRehash() {
+		err = user.Password.Set(input.Password)
+		if err == nil {
+			err = app.models.Users.Update(user)
+		}
+		if err != nil {
+			app.logger.Error("Failed to rehash password.", "user_id", user.ID, "error", err.Error())
+		}
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// maxTwoFactorAttempts is how many wrong codes can be sent with a two-factor pending token
+// before it's deleted
+const maxTwoFactorAttempts = 5
+
+// completeLogin is called once a user has proved who they are with their first factor, like
+// their password or a magic link. No way of logging in gets around a lockout, or an
+// administrator disabling the account. Users with two-factor authentication turned on aren't
+// logged in yet. Instead they get a short-lived token, which they exchange for an authentication
+// token at POST /v1/tokens/2fa along with a code from their authenticator app
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	lockout, err := app.models.LoginAttempts.GetLock(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if lockout != nil {
+		app.accountLockedResponse(w, r, lockout)
+		return
+	}
+
+	if user.Disabled {
+		app.accountDisabledResponse(w, r)
+		return
+	}
+
+	enabled, err := app.models.TwoFactor.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if enabled {
+		token, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeTwoFactorPending)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"two_factor_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.issueAuthenticationToken(w, r, user)
+}
+
+// issueAuthenticationToken is the last step of every way of logging in. Once the user has
+// proved who they are, we generate a short-lived token with scope 'authentication', and a
+// long-lived refresh token which the client can exchange for new ones at POST /v1/tokens/refresh.
+// When signed tokens are turned on, the authentication token is a signed one
+func (app *application) issueAuthenticationToken(w http.ResponseWriter, r *http.Request, user *data.User) {
+	ip, err := app.remoteIP(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// logging in wipes the slate clean. This mustn't happen any earlier, like when the password
+	// matches but a two-factor code is still needed, or guessing codes would never lock the account
+	err = app.models.LoginAttempts.ClearForEmail(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	access, refresh, err := app.models.Tokens.NewSession(user.ID, app.opaqueAccessTTL(), app.config.tokens.refreshTTL, r.UserAgent(), ip)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if app.signedTokensEnabled() {
+		access, err = app.issueSignedToken(user, refresh.Family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": access, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createTwoFactorAuthenticationTokenHandler exchanges the token from the first step of logging in,
+// along with a TOTP code or one of the user's recovery codes, for an authentication token. Wrong
+// codes count as failed logins, so guessing them is limited in the same way as guessing passwords
+func (app *application) createTwoFactorAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token        string `json:"two_factor_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateToken(v, data.ScopeTwoFactorPending, input.Token)
+	validateSecondFactor(v, input.Code, input.RecoveryCode)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeTwoFactorPending, input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("two_factor_token", "invalid or expired two-factor token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Disabled {
+		app.accountDisabledResponse(w, r)
+		return
+	}
+
+	ip, err := app.remoteIP(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	retryAfter, err := app.loginRetryAfter(user.Email, ip)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if retryAfter > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return
+	}
+
+	lockout, err := app.models.LoginAttempts.GetLock(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if lockout != nil {
+		app.accountLockedResponse(w, r, lockout)
+		return
+	}
+
+	verified, err := app.verifySecondFactor(user, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !verified {
+		err = app.recordLoginFailure(user.Email, ip, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// each pending token only gets a few guesses, after which the user has to start again
+		// with their password
+		err = app.models.Tokens.RecordFailedAttempt(data.ScopeTwoFactorPending, input.Token, maxTwoFactorAttempts)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		app.invalidCredentialResponse(w, r)
 		return
 	}
 
-	// otherwise, if the password is correct we generate a new token with a 24 hour ttl
-	// and scope 'authentication'
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// the pending token has done its job, so it can't be used again
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeTwoFactorPending, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.issueAuthenticationToken(w, r, user)
+}
+
+// createPasswordResetTokenHandler emails a password reset token to the user with the given
+// email address. So that the endpoint can't be used to find out which email addresses are
+// registered, we always send the same 202 Accepted response, and do all the work of looking
+// up the user and sending the email in the background, which means the response time doesn't
+// give anything away either
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.background(func() {
+		user, err := app.models.Users.GetByEmail(input.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.Error("Failed to look up user for password reset.", "error", err.Error())
+			}
+			return
+		}
+
+		// only activated accounts can reset their password, as we don't know for sure
+		// that anyone reads the email address of an account which hasn't been activated.
+		// Disabled accounts can't log in, so there's no point in them resetting it either
+		if !user.Activated || user.Disabled {
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.logger.Error("Failed to create password reset token.", "error", err.Error())
+			return
+		}
+
+		tokenData := map[string]any{
+			"passwordResetToken": token.Plaintext,
+		}
+
+		err = app.mailer.Send(user.Email, "password_reset.tmpl", tokenData)
+		if err != nil {
+			app.logger.Error("Failed to send password reset email.", "error", err.Error())
+		}
+	})
+
+	message := "if an account with this email address exists, an email will be sent to it containing password reset instructions"
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createRefreshedTokensHandler exchanges a refresh token for a new authentication token and
+// refresh token, like {"refresh_token": "..."}. Each refresh token can only be used once.
+// If a used one turns up again, the session it belongs to is revoked
+func (app *application) createRefreshedTokensHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateToken(v, data.ScopeRefresh, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	ip, err := app.remoteIP(r)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	access, refresh, err := app.models.Tokens.Rotate(input.RefreshToken, app.opaqueAccessTTL(), app.config.tokens.refreshTTL, r.UserAgent(), ip)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, data.ErrTokenReused):
+			app.logger.Warn("refresh token reused, session revoked", "user_id", refresh.UserID, "ip", ip)
+
+			// the session's signed access tokens have to be revoked too
+			err = app.revokeSignedTokens(refresh.UserID, refresh.Family)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if app.signedTokensEnabled() {
+		// signed tokens carry the user's activation status and permissions, so fetch them
+		// afresh. That's how changes to them reach a signed token holder
+		user, err := app.models.Users.Get(refresh.UserID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		access, err = app.issueSignedToken(user, refresh.Family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": access, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// opaqueAccessTTL is the TTL for authentication tokens stored in the database, which is zero
+// so that none are created when signed access tokens are issued instead
+func (app *application) opaqueAccessTTL() time.Duration {
+	if app.signedTokensEnabled() {
+		return 0
+	}
+
+	return app.config.tokens.accessTTL
+}
+
+// deleteAuthenticationTokenHandler logs out by deleting the authentication token the request
+// was made with, along with the refresh token issued alongside it. A signed token can't be
+// deleted, so its session is revoked instead
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if claims := app.contextGetClaims(r); claims != nil {
+		err = app.revokeSignedTokens(claims.Subject, claims.Session)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.Tokens.DeleteSession(claims.Subject, claims.Session)
+		if errors.Is(err, data.ErrRecordNotFound) {
+			err = nil
+		}
+	} else {
+		err = app.models.Tokens.DeleteFamily(data.ScopeAuthentication, app.contextGetToken(r))
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
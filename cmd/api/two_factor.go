@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"greenlight.twd.net/internal/data"
+	"greenlight.twd.net/internal/totp"
+	"greenlight.twd.net/internal/validator"
+	"net/http"
+	"time"
+)
+
+// The handlers in this file let users manage two-factor authentication for their own
+// account. Enrolling is done in two steps: POST /v1/users/me/2fa generates a secret for the
+// user to add to their authenticator app, and POST /v1/users/me/2fa/confirm turns 2FA on once
+// they send us a valid code, which proves the app was set up correctly. From then on, logging
+// in needs a code as well as a password.
+
+// totpIssuer is the name authenticator apps show next to the user's account
+const totpIssuer = "Greenlight"
+
+// validateSecondFactor checks that exactly one of a TOTP code and a recovery code was given
+func validateSecondFactor(v *validator.Validator, code, recoveryCode string) {
+	switch {
+	case code == "" && recoveryCode == "":
+		v.AddError("code", "must be provided, or a recovery_code used instead")
+	case code != "" && recoveryCode != "":
+		v.AddError("code", "must not be provided along with a recovery_code")
+	case code != "":
+		data.ValidateTOTPCode(v, code)
+	}
+}
+
+// verifySecondFactor checks a TOTP code or recovery code for a user with 2FA turned on.
+// Each code can only be used once: TOTP codes are tied to the time step they belong to,
+// and recovery codes are marked as used
+func (app *application) verifySecondFactor(user *data.User, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return app.models.TwoFactor.UseRecoveryCode(user.ID, recoveryCode)
+	}
+
+	tf, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	if !tf.Confirmed {
+		return false, nil
+	}
+
+	step, ok := totp.Validate(tf.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	return app.models.TwoFactor.UseStep(user.ID, step)
+}
+
+// twoFactorNotEnabledResponse is sent when a user tries to manage 2FA which isn't turned on
+func (app *application) twoFactorNotEnabledResponse(w http.ResponseWriter, r *http.Request) {
+	app.failedValidationResponse(w, r, map[string]string{"two_factor": "is not enabled"})
+}
+
+// showTwoFactorHandler returns whether the user has 2FA turned on, and how many of their
+// recovery codes are left
+func (app *application) showTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	enabled, err := app.models.TwoFactor.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	remaining, err := app.models.TwoFactor.RemainingRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	status := envelope{
+		"enabled":                  enabled,
+		"recovery_codes_remaining": remaining,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"two_factor": status}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// enrollTwoFactorHandler generates a new TOTP secret for the user, and returns it along with
+// an otpauth:// URI which can be turned into a QR code for authenticator apps to scan. 2FA
+// isn't turned on until the secret is confirmed, and enrolling again before then replaces it
+func (app *application) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TwoFactor.SetPending(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.failedValidationResponse(w, r, map[string]string{"two_factor": "is already enabled"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	enrollment := envelope{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(totpIssuer, user.Email, secret),
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"two_factor": enrollment}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmTwoFactorHandler turns 2FA on once the user sends a valid code for their new
+// secret. The response contains their recovery codes, which is the only time we can show
+// them, as we only store their hashes
+func (app *application) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	tf, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("two_factor", "must be enrolled in before it can be confirmed")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if tf.Confirmed {
+		v.AddError("two_factor", "is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	step, ok := totp.Validate(tf.Secret, input.Code, time.Now())
+	if !ok {
+		v.AddError("code", "is invalid")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.TwoFactor.Confirm(user.ID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	codes, err := app.models.TwoFactor.NewRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// disableTwoFactorHandler turns 2FA off. The user has to give their password along with
+// either a code or a recovery code, so that a stolen authentication token isn't enough
+func (app *application) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Password != "", "password", "must be provided")
+	validateSecondFactor(v, input.Code, input.RecoveryCode)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	enabled, err := app.models.TwoFactor.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !enabled {
+		app.twoFactorNotEnabledResponse(w, r)
+		return
+	}
+
+	matches, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !matches {
+		app.invalidCredentialResponse(w, r)
+		return
+	}
+
+	verified, err := app.verifySecondFactor(user, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !verified {
+		app.invalidCredentialResponse(w, r)
+		return
+	}
+
+	err = app.models.TwoFactor.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication successfully disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// regenerateRecoveryCodesHandler replaces the user's recovery codes with a fresh set, which
+// is useful once they've used a few of them. It needs a current TOTP code
+func (app *application) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	enabled, err := app.models.TwoFactor.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !enabled {
+		app.twoFactorNotEnabledResponse(w, r)
+		return
+	}
+
+	verified, err := app.verifySecondFactor(user, input.Code, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !verified {
+		app.invalidCredentialResponse(w, r)
+		return
+	}
+
+	codes, err := app.models.TwoFactor.NewRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
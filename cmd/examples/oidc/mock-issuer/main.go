@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// This is a mock OpenID Connect issuer for trying out single sign-on locally. It logs everyone
+// in as the same user without asking, so it must never be used for anything else. Start it,
+// then start the API pointing at it:
+//
+//	go run ./cmd/examples/oidc/mock-issuer -email alice@example.com
+//	go run ./cmd/api -oidc-issuer http://localhost:9000 -oidc-client-id greenlight \
+//		-oidc-client-secret secret -oidc-auto-provision
+//
+// and open http://localhost:4000/v1/auth/oidc/login in a browser, or follow the redirects with
+// curl, which needs a cookie jar as the login is bound to the client which started it:
+//
+//	curl -L -c cookies.txt -b cookies.txt http://localhost:4000/v1/auth/oidc/login
+//
+// It checks the client credentials, redirect URI and PKCE code verifier like a real issuer
+// would, and signs ID tokens with an RS256 key which is generated when it starts.
+
+// authorization is an authorization code which hasn't been exchanged yet
+type authorization struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	expiry      time.Time
+}
+
+type issuer struct {
+	url          string
+	clientID     string
+	clientSecret string
+	subject      string
+	email        string
+	name         string
+	verified     bool
+	key          *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+var encoding = base64.RawURLEncoding
+
+func main() {
+	addr := flag.String("addr", ":9000", "Server address")
+
+	var iss issuer
+
+	flag.StringVar(&iss.url, "issuer", "http://localhost:9000", "Issuer URL, which must match the API's -oidc-issuer")
+	flag.StringVar(&iss.clientID, "client-id", "greenlight", "Client ID the API must use")
+	flag.StringVar(&iss.clientSecret, "client-secret", "secret", "Client secret the API must use")
+	flag.StringVar(&iss.subject, "subject", "mock-user-1", "Subject of the user everyone is logged in as")
+	flag.StringVar(&iss.email, "email", "alice@example.com", "Email address of the user")
+	flag.StringVar(&iss.name, "name", "Alice", "Name of the user")
+	flag.BoolVar(&iss.verified, "email-verified", true, "Whether the email address is verified")
+	flag.Parse()
+
+	var err error
+
+	iss.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	iss.codes = make(map[string]authorization)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", iss.discovery)
+	mux.HandleFunc("/authorize", iss.authorize)
+	mux.HandleFunc("/token", iss.token)
+	mux.HandleFunc("/jwks", iss.jwks)
+
+	log.Printf("mock issuer %s listening on %s", iss.url, *addr)
+
+	err = http.ListenAndServe(*addr, mux)
+	log.Fatal(err)
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func (iss *issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                iss.url,
+		"authorization_endpoint":                iss.url + "/authorize",
+		"token_endpoint":                        iss.url + "/token",
+		"jwks_uri":                              iss.url + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// authorize approves every login straight away, and redirects back to the client with a code
+func (iss *issuer) authorize(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	if qs.Get("client_id") != iss.clientID || qs.Get("response_type") != "code" {
+		http.Error(w, "unknown client or unsupported response type", http.StatusBadRequest)
+		return
+	}
+
+	if qs.Get("code_challenge_method") != "S256" || qs.Get("code_challenge") == "" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+
+	redirect, err := url.Parse(qs.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+
+	iss.mu.Lock()
+	iss.codes[code] = authorization{
+		redirectURI: qs.Get("redirect_uri"),
+		challenge:   qs.Get("code_challenge"),
+		nonce:       qs.Get("nonce"),
+		expiry:      time.Now().Add(time.Minute),
+	}
+	iss.mu.Unlock()
+
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", qs.Get("state"))
+	redirect.RawQuery = params.Encode()
+
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// token exchanges a code for an ID token, checking the PKCE code verifier against the challenge
+func (iss *issuer) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	}
+
+	if clientID != iss.clientID || clientSecret != iss.clientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	code := r.PostFormValue("code")
+
+	iss.mu.Lock()
+	auth, found := iss.codes[code]
+	delete(iss.codes, code)
+	iss.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+
+	switch {
+	case r.PostFormValue("grant_type") != "authorization_code":
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	case !found || time.Now().After(auth.expiry) || auth.redirectURI != r.PostFormValue("redirect_uri"):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	case encoding.EncodeToString(sum[:]) != auth.challenge:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	now := time.Now()
+
+	idToken, err := iss.sign(map[string]any{
+		"iss":            iss.url,
+		"sub":            iss.subject,
+		"aud":            iss.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          auth.nonce,
+		"email":          iss.email,
+		"email_verified": iss.verified,
+		"name":           iss.name,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (iss *issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   encoding.EncodeToString(iss.key.N.Bytes()),
+			"e":   encoding.EncodeToString(big.NewInt(int64(iss.key.E)).Bytes()),
+		}},
+	})
+}
+
+// sign returns an RS256 JWT with the given claims
+func (iss *issuer) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "mock"})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, iss.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return encoding.EncodeToString(b)
+}
@@ -0,0 +1,320 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/lib/pq"
+	"greenlight.twd.net/internal/validator"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ApiKeyModel defines struct type which wraps a sql.DB connection pool
+type ApiKeyModel struct {
+	DB *sql.DB
+}
+
+// ApiKey is a long-lived credential for machine clients, owned by a user. A key only has the
+// permission codes it was created with, and only while its owner still has them too. If CIDRs
+// isn't empty, the key can only be used from addresses in those ranges. Like tokens, only a
+// hash of the key is stored, and the plaintext is only available when the key is created.
+// Prefix is the start of the plaintext, so that users can tell their keys apart
+type ApiKey struct {
+	ID          int64       `json:"id"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Permissions Permissions `json:"permissions"`
+	CIDRs       []string    `json:"cidrs"`
+	CreatedAt   time.Time   `json:"created_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+	Expiry      *time.Time  `json:"expiry"`
+}
+
+// apiKeyScopeCode is the scope code in the token format for API keys, which use the same
+// format as tokens so that secret scanners pick them up too
+const apiKeyScopeCode = "key"
+
+// apiKeyPrefixLength is how much of the plaintext is kept as the key's prefix, which is
+// "glt_key_" and the first few characters of the random part
+const apiKeyPrefixLength = 16
+
+// legacyApiKeyRX matches API keys issued before they used the token format
+var legacyApiKeyRX = regexp.MustCompile(`^[a-z2-7]{52}$`)
+
+// apiKeyTouchInterval is how out of date an API key's last_used_at is allowed to get, which
+// saves a write on almost every request, as with sessions
+const apiKeyTouchInterval = time.Minute
+
+// ValidateApiKey runs our validation checks on a new API key
+func ValidateApiKey(v *validator.Validator, key *ApiKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) > 0, "permissions", "must contain at least 1 permission code")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	v.Check(validator.Unique(key.CIDRs), "cidrs", "must not contain duplicate values")
+	for _, cidr := range key.CIDRs {
+		_, _, err := net.ParseCIDR(cidr)
+		v.Check(err == nil, "cidrs", "must only contain CIDR ranges, like 192.0.2.0/24")
+	}
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// ValidateApiKeyPlaintext checks that an API key from a client looks like one of ours, in the
+// token format with the API key scope code. Older keys, which are 52 characters of lower
+// case base32, are still accepted
+func ValidateApiKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(plaintext != "", "key", "must be provided")
+
+	if legacyApiKeyRX.MatchString(plaintext) {
+		return
+	}
+
+	code, ok := parseSecret(plaintext)
+	v.Check(ok && code == apiKeyScopeCode, "key", "must be a valid API key")
+}
+
+// AllowsIP reports whether the key can be used from the given IP address
+func (k *ApiKey) AllowsIP(ip string) bool {
+	if len(k.CIDRs) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, cidr := range k.CIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Insert generates the plaintext for a new API key and stores its hash
+func (m ApiKeyModel) Insert(key *ApiKey) error {
+	// keys live much longer than tokens, so they get twice as much randomness
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	random := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	key.Plaintext = formatSecret(apiKeyScopeCode, random)
+	key.Prefix = key.Plaintext[:apiKeyPrefixLength]
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	if key.CIDRs == nil {
+		key.CIDRs = []string{}
+	}
+
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, hash, permissions, cidrs, expiry)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array(key.Permissions), pq.Array(key.CIDRs), key.Expiry}
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// apiKeyColumns is the list of columns selected by the queries which return API keys on their own
+const apiKeyColumns = `id, user_id, name, prefix, permissions, cidrs, created_at, last_used_at, expiry`
+
+// scanApiKey scans a row selected with apiKeyColumns into an ApiKey
+func scanApiKey(row interface{ Scan(...any) error }) (*ApiKey, error) {
+	var key ApiKey
+
+	err := row.Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		pq.Array(&key.CIDRs),
+		&key.CreatedAt,
+		&key.LastUsedAt,
+		&key.Expiry,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// GetAllForUser returns a user's API keys, newest first
+func (m ApiKeyModel) GetAllForUser(userID int64) ([]*ApiKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = $1 ORDER BY id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := []*ApiKey{}
+
+	for rows.Next() {
+		key, err := scanApiKey(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetForAuthentication retrieves the unexpired API key with the given plaintext, along with
+// the user who owns it and every permission code that user has, returning ErrRecordNotFound
+// if there's no such key. Keys are checked on every request they're used for, so all of this
+// comes back from a single query rather than a query for each part
+func (m ApiKeyModel) GetForAuthentication(plaintext string) (*ApiKey, *User, Permissions, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	// the permissions subquery is the same as PermissionsModel.GetAllForUser's
+	query := `
+		SELECT api_keys.id, api_keys.user_id, api_keys.name, api_keys.prefix, api_keys.permissions,
+			api_keys.cidrs, api_keys.created_at, api_keys.last_used_at, api_keys.expiry,
+			users.id, users.created_at, users.name, users.email, COALESCE(users.pending_email, ''),
+			users.password_hash, users.activated, users.disabled, users.version,
+			ARRAY(
+				SELECT permissions.code
+				FROM permissions
+				INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+				WHERE users_permissions.user_id = users.id
+				UNION
+				SELECT permissions.code
+				FROM permissions
+				INNER JOIN role_permissions ON role_permissions.permission_id = permissions.id
+				INNER JOIN user_roles ON user_roles.role_id = role_permissions.role_id
+				WHERE user_roles.user_id = users.id
+				ORDER BY code
+			)
+		FROM api_keys
+		INNER JOIN users ON users.id = api_keys.user_id
+		WHERE api_keys.hash = $1 AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var key ApiKey
+	var user User
+	var permissions Permissions
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], time.Now()).Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		pq.Array(&key.CIDRs),
+		&key.CreatedAt,
+		&key.LastUsedAt,
+		&key.Expiry,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.PendingEmail,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Disabled,
+		&user.Version,
+		pq.Array(&permissions),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, nil, err
+		}
+	}
+
+	return &key, &user, permissions, nil
+}
+
+// Touch records that an API key has just been used. As with tokens, nothing happens if it
+// has already been used in the last apiKeyTouchInterval, and when the key we've loaded
+// says so, the database isn't asked at all
+func (m ApiKeyModel) Touch(key *ApiKey) error {
+	if key.LastUsedAt != nil && time.Since(*key.LastUsedAt) < apiKeyTouchInterval {
+		return nil
+	}
+
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key.ID, time.Now().Add(-apiKeyTouchInterval))
+	return err
+}
+
+// Delete deletes one of the user's API keys, returning ErrRecordNotFound if the user has
+// no such key
+func (m ApiKeyModel) Delete(userID int64, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Audit actions. Each one is named after the type of record which changed, and what happened to it
+const (
+	AuditPermissionCreate = "permission.create"
+	AuditPermissionUpdate = "permission.update"
+	AuditPermissionDelete = "permission.delete"
+	AuditPermissionGrant  = "permission.grant"
+	AuditPermissionRevoke = "permission.revoke"
+	AuditRoleCreate       = "role.create"
+	AuditRoleUpdate       = "role.update"
+	AuditRoleDelete       = "role.delete"
+	AuditRoleGrant        = "role.grant"
+	AuditRoleRevoke       = "role.revoke"
+)
+
+// AuditModel defines struct type which wraps a sql.DB connection pool
+type AuditModel struct {
+	DB *sql.DB
+}
+
+// AuditEvent records a change made to a sensitive record, and who made it. ActorID is nil
+// for changes made by the system itself, or when the user who made them has since been
+// deleted. The target is identified by its type (like "user") and ID, which is a string so
+// that records with other kinds of key can be audited too.
+type AuditEvent struct {
+	ID         int64          `json:"id"`
+	CreatedAt  time.Time      `json:"created_at"`
+	ActorID    *int64         `json:"actor_id"`
+	Action     string         `json:"action"`
+	TargetType string         `json:"target_type"`
+	TargetID   string         `json:"target_id"`
+	Details    map[string]any `json:"details,omitempty"`
+}
+
+// Insert records a new audit event
+func (m AuditModel) Insert(event *AuditEvent) error {
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return err
+	}
+
+	// a nil map is encoded as null, but the column wants an object
+	if event.Details == nil {
+		details = []byte("{}")
+	}
+
+	query := `
+		INSERT INTO audit_events (actor_id, action, target_type, target_id, details)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{event.ActorID, event.Action, event.TargetType, event.TargetID, details}
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
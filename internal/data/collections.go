@@ -0,0 +1,301 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"greenlight.twd.net/internal/validator"
+	"strings"
+	"time"
+)
+
+// Kinds of collection. Franchises group related titles together and aren't owned by
+// anyone, whereas curated collections are editorial lists owned by the user who made them
+const (
+	CollectionKindFranchise = "franchise"
+	CollectionKindCurated   = "curated"
+)
+
+// ErrUnknownMovie is returned when a collection references a movie which doesn't exist
+var (
+	ErrUnknownMovie = errors.New("unknown movie")
+)
+
+// CollectionModel defines struct type which wraps a sql.DB connection pool
+type CollectionModel struct {
+	DB *sql.DB
+}
+
+// Collection holds the data for a franchise or curated list. MovieIDs holds the
+// members of the collection in order, the first movie in the slice comes first
+type Collection struct {
+	ID          int64     `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Kind        string    `json:"kind"`
+	OwnerID     *int64    `json:"owner_id,omitempty"`
+	MovieIDs    []int64   `json:"movie_ids"`
+	Version     int32     `json:"version"`
+}
+
+// IsOwnedBy reports whether the collection is a curated list owned by the given user.
+// Franchises have no owner, so this is always false for them
+func (c *Collection) IsOwnedBy(userID int64) bool {
+	return c.OwnerID != nil && *c.OwnerID == userID
+}
+
+// ValidateCollection runs our validation checks on a collection
+func ValidateCollection(v *validator.Validator, collection *Collection) {
+	v.Check(collection.Name != "", "name", "name must not be empty")
+	v.Check(len(collection.Name) <= 500, "name", "name must be less then 500 bytes long")
+
+	v.Check(len(collection.Description) <= 10_000, "description", "description must be less then 10000 bytes long")
+
+	v.Check(validator.PermittedValue(collection.Kind, CollectionKindFranchise, CollectionKindCurated), "kind", "must be one of franchise or curated")
+
+	v.Check(collection.MovieIDs != nil, "movie_ids", "movie_ids must be provided")
+	v.Check(len(collection.MovieIDs) <= 1000, "movie_ids", "cannot contain more than 1000 movies")
+	v.Check(validator.Unique(collection.MovieIDs), "movie_ids", "cannot contain duplicate movies")
+
+	for _, id := range collection.MovieIDs {
+		if id < 1 {
+			v.AddError("movie_ids", "must only contain valid movie IDs")
+			break
+		}
+	}
+}
+
+// setMovies replaces the membership of a collection with movieIDs, inside the
+// given transaction. WITH ORDINALITY numbers the unnested IDs 1, 2, 3..., which
+// gives us the position of each movie in the collection.
+func setMovies(ctx context.Context, tx *sql.Tx, collectionID int64, movieIDs []int64) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM collections_movies WHERE collection_id = $1`, collectionID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO collections_movies (collection_id, movie_id, position)
+		SELECT $1, members.movie_id, members.position
+		FROM unnest($2::bigint[]) WITH ORDINALITY AS members(movie_id, position)`
+
+	_, err = tx.ExecContext(ctx, query, collectionID, pq.Array(movieIDs))
+	if err != nil {
+		switch {
+		case strings.Contains(err.Error(), `violates foreign key constraint "collections_movies_movie_id_fkey"`):
+			return ErrUnknownMovie
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Insert inserts a new collection, along with its movies, in a single transaction
+func (m CollectionModel) Insert(collection *Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO collections (name, description, kind, owner_id)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version`
+
+	args := []any{collection.Name, collection.Description, collection.Kind, collection.OwnerID}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&collection.ID, &collection.CreatedAt, &collection.Version)
+	if err != nil {
+		return err
+	}
+
+	err = setMovies(ctx, tx, collection.ID, collection.MovieIDs)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Get retrieves a collection by its ID, including its ordered movie IDs
+func (m CollectionModel) Get(id int64) (*Collection, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, description, kind, owner_id, version,
+			ARRAY(SELECT movie_id FROM collections_movies
+				WHERE collection_id = collections.id ORDER BY position)
+		FROM collections
+		WHERE id = $1`
+
+	var collection Collection
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&collection.ID,
+		&collection.CreatedAt,
+		&collection.Name,
+		&collection.Description,
+		&collection.Kind,
+		&collection.OwnerID,
+		&collection.Version,
+		pq.Array(&collection.MovieIDs),
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &collection, nil
+}
+
+// GetAll retrieves a paginated list of collections, optionally filtered by a
+// full-text search on the name and by kind
+func (m CollectionModel) GetAll(name string, kind string, filters Filters) ([]*Collection, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, description, kind, owner_id, version,
+			ARRAY(SELECT movie_id FROM collections_movies
+				WHERE collection_id = collections.id ORDER BY position)
+		FROM collections
+		WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		AND (kind = $2 OR $2 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, name, kind, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	collections := []*Collection{}
+
+	for rows.Next() {
+		var collection Collection
+
+		err := rows.Scan(
+			&totalRecords,
+			&collection.ID,
+			&collection.CreatedAt,
+			&collection.Name,
+			&collection.Description,
+			&collection.Kind,
+			&collection.OwnerID,
+			&collection.Version,
+			pq.Array(&collection.MovieIDs),
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		collections = append(collections, &collection)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return collections, metadata, nil
+}
+
+// Update updates a collection and replaces its movies in a single transaction,
+// using the version field to guard against edit conflicts
+func (m CollectionModel) Update(collection *Collection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+		UPDATE collections
+		SET name = $1, description = $2, kind = $3, owner_id = $4, version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`
+
+	args := []any{
+		collection.Name,
+		collection.Description,
+		collection.Kind,
+		collection.OwnerID,
+		collection.ID,
+		collection.Version,
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&collection.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	err = setMovies(ctx, tx, collection.ID, collection.MovieIDs)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes a collection by its ID. Its membership rows are removed by the
+// ON DELETE CASCADE constraint, but the movies themselves are left alone
+func (m CollectionModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM collections
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
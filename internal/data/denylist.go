@@ -0,0 +1,120 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lib/pq"
+	"time"
+)
+
+// DenylistModel defines struct type which wraps a sql.DB connection pool
+type DenylistModel struct {
+	DB *sql.DB
+}
+
+// DenylistEntry revokes signed access tokens, which can't simply be deleted like the tokens
+// in the tokens table. It matches the user's tokens which were issued at or before
+// IssuedBefore, either all of them or just those for one session when Session is set.
+// Signed tokens don't outlive their TTL, so neither do the entries
+type DenylistEntry struct {
+	UserID       int64
+	Session      int64
+	IssuedBefore time.Time
+	Expiry       time.Time
+}
+
+// Matches reports whether the entry revokes a token issued to userID for session at issuedAt
+func (e *DenylistEntry) Matches(userID, session int64, issuedAt time.Time) bool {
+	if e.UserID != userID {
+		return false
+	}
+
+	if e.Session != 0 && e.Session != session {
+		return false
+	}
+
+	return !issuedAt.After(e.IssuedBefore)
+}
+
+// Insert adds an entry to the denylist
+func (m DenylistModel) Insert(entry *DenylistEntry) error {
+	query := `
+		INSERT INTO token_denylist (user_id, session, issued_before, expiry)
+		VALUES ($1, NULLIF($2, 0), $3, $4)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{entry.UserID, entry.Session, entry.IssuedBefore, entry.Expiry}
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// InsertForUsers adds an entry for each of the users, revoking all of their tokens issued up
+// to issuedBefore, like when a role which lots of users have is changed
+func (m DenylistModel) InsertForUsers(userIDs []int64, issuedBefore, expiry time.Time) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	query := `
+		INSERT INTO token_denylist (user_id, issued_before, expiry)
+		SELECT unnest($1::bigint[]), $2, $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(userIDs), issuedBefore, expiry)
+	return err
+}
+
+// GetActive returns every entry which hasn't expired yet
+func (m DenylistModel) GetActive() ([]*DenylistEntry, error) {
+	query := `
+		SELECT user_id, COALESCE(session, 0), issued_before, expiry
+		FROM token_denylist
+		WHERE expiry > NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := []*DenylistEntry{}
+
+	for rows.Next() {
+		var entry DenylistEntry
+
+		err := rows.Scan(&entry.UserID, &entry.Session, &entry.IssuedBefore, &entry.Expiry)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// DeleteExpired deletes the entries which have expired, as every token they could match has too
+func (m DenylistModel) DeleteExpired() error {
+	query := `
+		DELETE FROM token_denylist
+		WHERE expiry <= NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
@@ -0,0 +1,66 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// EmailLimitModel defines struct type which wraps a sql.DB connection pool
+type EmailLimitModel struct {
+	DB *sql.DB
+}
+
+// Allow reports whether a request of the given kind, like "magic-link-send", is allowed for
+// the email address. Each address gets a burst of requests, and then one more every interval.
+// The limits are kept in the database, like failed logins, so that they hold across every
+// instance of the API.
+//
+// Rather than counting requests, we store when the address's bucket will next be full, which
+// is called the theoretical arrival time. Each request moves it interval further into the
+// future, and a request is allowed as long as that doesn't take it more than burst intervals
+// ahead of now. Doing that in a single statement means two instances can't both let the
+// last request in the burst through
+func (m EmailLimitModel) Allow(kind, email string, interval time.Duration, burst int) (bool, error) {
+	query := `
+		INSERT INTO email_rate_limits (kind, email, tat)
+		VALUES ($1, $2, NOW() + make_interval(secs => $3))
+		ON CONFLICT (kind, email) DO UPDATE
+		SET tat = GREATEST(email_rate_limits.tat, NOW()) + make_interval(secs => $3)
+		WHERE email_rate_limits.tat <= NOW() + make_interval(secs => $4)
+		RETURNING tat`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{kind, email, interval.Seconds(), (time.Duration(burst-1) * interval).Seconds()}
+
+	var tat time.Time
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&tat)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// DeleteExpired forgets the email addresses whose buckets have filled back up, which behave
+// the same as addresses we've never seen
+func (m EmailLimitModel) DeleteExpired() error {
+	query := `
+		DELETE FROM email_rate_limits
+		WHERE tat <= NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
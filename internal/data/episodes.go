@@ -0,0 +1,227 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"greenlight.twd.net/internal/validator"
+	"time"
+)
+
+// EpisodeModel defines struct type which wraps a sql.DB connection pool
+type EpisodeModel struct {
+	DB *sql.DB
+}
+
+// Episode struct holds the data for a single episode of a season. Notice that
+// we reuse the custom Runtime type, so episode runtimes are read and written
+// in exactly the same formats as movies.
+type Episode struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	SeasonID  int64     `json:"season_id"`
+	Number    int32     `json:"number"`
+	Title     string    `json:"title"`
+	Runtime   Runtime   `json:"runtime"`
+	Version   int32     `json:"version"`
+
+	// RuntimeFormat controls how the runtime is written out in JSON, in the same way as for movies
+	RuntimeFormat RuntimeFormat `json:"-"`
+}
+
+// MarshalJSON writes the episode out with its runtime in the requested RuntimeFormat,
+// see Movie.MarshalJSON for how this works
+func (e Episode) MarshalJSON() ([]byte, error) {
+	type episodeJSON Episode
+
+	return json.Marshal(struct {
+		episodeJSON
+		Runtime any `json:"runtime"`
+	}{
+		episodeJSON: episodeJSON(e),
+		Runtime:     e.Runtime.Format(e.RuntimeFormat),
+	})
+}
+
+// ValidateEpisode runs our validation checks on an episode
+func ValidateEpisode(v *validator.Validator, episode *Episode) {
+	v.Check(episode.Number >= 1, "number", "must be greater than zero")
+
+	v.Check(episode.Title != "", "title", "title must not be empty")
+	v.Check(len(episode.Title) <= 500, "title", "title must be less then 500 bytes long")
+
+	v.Check(episode.Runtime != 0, "runtime", "must provide a valid runtime")
+	v.Check(episode.Runtime > 0, "runtime", "runtime must be greater than 0")
+}
+
+// Insert inserts a new record into the episodes table
+func (m EpisodeModel) Insert(episode *Episode) error {
+	query := `
+		INSERT INTO episodes (season_id, number, title, runtime)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{episode.SeasonID, episode.Number, episode.Title, episode.Runtime}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&episode.ID, &episode.CreatedAt, &episode.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "episodes_season_id_number_key"`:
+			return ErrDuplicateNumber
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// GetByNumber retrieves an episode by its number within the given season
+func (m EpisodeModel) GetByNumber(seasonID int64, number int32) (*Episode, error) {
+	if seasonID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, season_id, number, title, runtime, version
+		FROM episodes
+		WHERE season_id = $1 AND number = $2`
+
+	var episode Episode
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, seasonID, number).Scan(
+		&episode.ID,
+		&episode.CreatedAt,
+		&episode.SeasonID,
+		&episode.Number,
+		&episode.Title,
+		&episode.Runtime,
+		&episode.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &episode, nil
+}
+
+// GetAllForSeason retrieves every episode of a season, ordered by episode number
+func (m EpisodeModel) GetAllForSeason(seasonID int64) ([]*Episode, error) {
+	query := `
+		SELECT id, created_at, season_id, number, title, runtime, version
+		FROM episodes
+		WHERE season_id = $1
+		ORDER BY number ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, seasonID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	episodes := []*Episode{}
+
+	for rows.Next() {
+		var episode Episode
+
+		err := rows.Scan(
+			&episode.ID,
+			&episode.CreatedAt,
+			&episode.SeasonID,
+			&episode.Number,
+			&episode.Title,
+			&episode.Runtime,
+			&episode.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		episodes = append(episodes, &episode)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return episodes, nil
+}
+
+// Update updates an existing record in the episodes table, using the version
+// field to guard against edit conflicts
+func (m EpisodeModel) Update(episode *Episode) error {
+	query := `
+		UPDATE episodes
+		SET number = $1, title = $2, runtime = $3, version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{
+		episode.Number,
+		episode.Title,
+		episode.Runtime,
+		episode.ID,
+		episode.Version,
+	}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&episode.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "episodes_season_id_number_key"`:
+			return ErrDuplicateNumber
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes a record from the episodes table by its ID
+func (m EpisodeModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM episodes
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"greenlight.twd.net/internal/validator"
+	"regexp"
+	"time"
+)
+
+// ErrExternalIDConflict is returned when an external ID can't be linked to a movie, because
+// either the ID or the movie is already linked to something else
+var ErrExternalIDConflict = errors.New("external ID conflict")
+
+// External ID sources which our partner feeds key movies by
+const (
+	SourceIMDb = "imdb"
+	SourceTMDb = "tmdb"
+)
+
+// externalIDRX holds the expected format of the identifiers for each source
+var externalIDRX = map[string]*regexp.Regexp{
+	SourceIMDb: regexp.MustCompile(`^tt\d{7,10}$`),
+	SourceTMDb: regexp.MustCompile(`^\d{1,10}$`),
+}
+
+// ExternalIDs maps an external source (like "imdb") to the identifier that source
+// uses for a movie. It implements the sql.Scanner interface so that we can read
+// the JSON object built by jsonb_object_agg() straight into it.
+type ExternalIDs map[string]string
+
+// Scan implements the sql.Scanner interface
+func (e *ExternalIDs) Scan(src any) error {
+	var b []byte
+
+	switch v := src.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	case nil:
+		*e = nil
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into ExternalIDs", src)
+	}
+
+	ids := ExternalIDs{}
+
+	err := json.Unmarshal(b, &ids)
+	if err != nil {
+		return err
+	}
+
+	// leave the map nil when there are no IDs, so that the field is omitted from JSON output
+	if len(ids) == 0 {
+		*e = nil
+		return nil
+	}
+
+	*e = ids
+	return nil
+}
+
+// externalIDsColumn is the SQL expression used to select all of a movie's external IDs
+// as a single JSON object. It's shared by every query which returns movies.
+const externalIDsColumn = `COALESCE((SELECT jsonb_object_agg(external_ids.source, external_ids.value)
+			FROM external_ids WHERE external_ids.movie_id = movies.id), '{}')`
+
+// ValidateExternalID checks that the source is one we know about, and that the
+// identifier is in the format that source uses
+func ValidateExternalID(v *validator.Validator, source, value string) {
+	rx, ok := externalIDRX[source]
+	v.Check(ok, "source", "must be one of imdb or tmdb")
+	if ok {
+		v.Check(v.Matches(value, rx), "value", fmt.Sprintf("must be a valid %s identifier", source))
+	}
+}
+
+// GetByExternalID retrieves the movie which the given source identifies by value
+func (m MovieModel) GetByExternalID(source, value string) (*Movie, error) {
+	query := `
+		SELECT movie_id
+		FROM external_ids
+		WHERE source = $1 AND value = $2`
+
+	var id int64
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, source, value).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return m.Get(id)
+}
+
+// UpsertByExternalID creates or updates the movie which the given source identifies by
+// value, returning true if a new movie was created. Everything happens inside a single
+// transaction, and we take a transaction-scoped advisory lock on the (source, value)
+// pair first. This means that two sync jobs pushing the same movie at the same time
+// are serialized, rather than both deciding the movie doesn't exist yet and creating it
+// twice. If movie.Version is non-zero, the update only succeeds if it matches the
+// current version of the record, in the same way as Update().
+//
+// If movie.ID is non-zero, the identifier is for that existing movie, which lets feeds attach
+// their IDs to movies created through POST /v1/movies or keyed by another source. The ID is
+// linked to the movie if it isn't linked to anything yet, and ErrExternalIDConflict is
+// returned if it's already linked to a different movie, or the movie already has an ID from
+// this source. ErrRecordNotFound is returned if there's no such movie.
+func (m MovieModel) UpsertByExternalID(source, value string, movie *Movie) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	// Rollback() is a no-op if the transaction has already been committed
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, source+":"+value)
+	if err != nil {
+		return false, err
+	}
+
+	var id int64
+	created := false
+
+	err = tx.QueryRowContext(ctx, `SELECT movie_id FROM external_ids WHERE source = $1 AND value = $2`, source, value).Scan(&id)
+	switch {
+	case err == nil && movie.ID != 0 && movie.ID != id:
+		return false, ErrExternalIDConflict
+
+	case errors.Is(err, sql.ErrNoRows) && movie.ID != 0:
+		// link the ID to the existing movie, and then update it below like any other
+		id = movie.ID
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO external_ids (source, value, movie_id) VALUES ($1, $2, $3)`, source, value, id)
+		if err != nil {
+			switch {
+			case err.Error() == `pq: duplicate key value violates unique constraint "external_ids_movie_id_source_key"`:
+				return false, ErrExternalIDConflict
+			case err.Error() == `pq: insert or update on table "external_ids" violates foreign key constraint "external_ids_movie_id_fkey"`:
+				return false, ErrRecordNotFound
+			default:
+				return false, err
+			}
+		}
+
+	case errors.Is(err, sql.ErrNoRows):
+		query := `
+			INSERT INTO movies (title, year, runtime, genres, synopsis, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id, created_at, version`
+
+		args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.Synopsis, movie.CreatedBy}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+		if err != nil {
+			return false, err
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO external_ids (source, value, movie_id) VALUES ($1, $2, $3)`, source, value, movie.ID)
+		if err != nil {
+			return false, err
+		}
+
+		created = true
+
+	case err != nil:
+		return false, err
+	}
+
+	if !created {
+		// a version of zero means the client didn't ask for an optimistic check
+		query := `
+			UPDATE movies
+			SET title = $1, year = $2, runtime = $3, genres = $4, synopsis = $5, version = version + 1
+			WHERE id = $6 AND (version = $7 OR $7 = 0)
+			RETURNING id, created_at, created_by, version`
+
+		args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.Synopsis, id, movie.Version}
+
+		err = tx.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.CreatedBy, &movie.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return false, ErrEditConflict
+			default:
+				return false, err
+			}
+		}
+	}
+
+	// read back the full set of external IDs, as the movie may be known to other sources too
+	query := fmt.Sprintf(`SELECT %s FROM movies WHERE id = $1`, externalIDsColumn)
+
+	err = tx.QueryRowContext(ctx, query, movie.ID).Scan(&movie.ExternalIDs)
+	if err != nil {
+		return false, err
+	}
+
+	return created, tx.Commit()
+}
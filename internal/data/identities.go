@@ -0,0 +1,162 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrDuplicateIdentity is returned when an external identity is already linked to a user
+var ErrDuplicateIdentity = errors.New("duplicate identity")
+
+// IdentityModel defines struct type which wraps a sql.DB connection pool
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// Identity links a user to an account with an external OpenID Connect issuer. Subject is the
+// issuer's ID for the account, which unlike the email address never changes. Email is the
+// address the issuer vouched for when the identity was linked
+type Identity struct {
+	ID        int64
+	UserID    int64
+	Issuer    string
+	Subject   string
+	Email     string
+	CreatedAt time.Time
+}
+
+// Insert links an identity to a user, returning ErrDuplicateIdentity if it's already linked
+func (m IdentityModel) Insert(identity *Identity) error {
+	query := `
+		INSERT INTO user_identities (user_id, issuer, subject, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{identity.UserID, identity.Issuer, identity.Subject, identity.Email}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&identity.ID, &identity.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "user_identities_issuer_subject_key"`:
+			return ErrDuplicateIdentity
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetUserID returns the ID of the user an identity is linked to, returning ErrRecordNotFound
+// if it isn't linked to anyone
+func (m IdentityModel) GetUserID(issuer, subject string) (int64, error) {
+	query := `
+		SELECT user_id
+		FROM user_identities
+		WHERE issuer = $1 AND subject = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userID int64
+
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return userID, nil
+}
+
+// OIDCStateModel defines struct type which wraps a sql.DB connection pool
+type OIDCStateModel struct {
+	DB *sql.DB
+}
+
+// OIDCState is what we need to remember between sending a user to the issuer to log in and
+// them coming back: the PKCE code verifier, and the nonce the ID token must carry. It's found
+// by the state parameter, which the issuer hands back to us unchanged, along with Binding,
+// which is kept in a cookie by the browser that started the login. The state travels in the
+// callback URL next to the code, so on its own it would let anyone who saw that URL finish
+// the login. Like tokens, only hashes of the state and binding are stored
+type OIDCState struct {
+	State    string
+	Binding  string
+	Verifier string
+	Nonce    string
+	Expiry   time.Time
+}
+
+// Insert stores a login's state
+func (m OIDCStateModel) Insert(state *OIDCState) error {
+	hash := sha256.Sum256([]byte(state.State))
+	bindingHash := sha256.Sum256([]byte(state.Binding))
+
+	query := `
+		INSERT INTO oidc_states (hash, binding_hash, verifier, nonce, expiry)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{hash[:], bindingHash[:], state.Verifier, state.Nonce, state.Expiry}
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Consume retrieves and deletes the unexpired state with the given value and binding, so that
+// each one can only be used once, returning ErrRecordNotFound if there's no such state. A state
+// presented with the wrong binding is left alone, so the real user can still finish logging in
+func (m OIDCStateModel) Consume(value, binding string) (*OIDCState, error) {
+	hash := sha256.Sum256([]byte(value))
+	bindingHash := sha256.Sum256([]byte(binding))
+
+	query := `
+		DELETE FROM oidc_states
+		WHERE hash = $1 AND binding_hash = $2
+		RETURNING verifier, nonce, expiry`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	state := OIDCState{State: value, Binding: binding}
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], bindingHash[:]).Scan(&state.Verifier, &state.Nonce, &state.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if !state.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &state, nil
+}
+
+// DeleteExpired deletes the states of logins which were never finished
+func (m OIDCStateModel) DeleteExpired() error {
+	query := `DELETE FROM oidc_states WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
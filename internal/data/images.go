@@ -0,0 +1,106 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Kinds of artwork which can be attached to a movie
+const (
+	ImageKindPoster   = "poster"
+	ImageKindBackdrop = "backdrop"
+)
+
+// MovieImageModel defines struct type which wraps a sql.DB connection pool
+type MovieImageModel struct {
+	DB *sql.DB
+}
+
+// MovieImage holds the metadata for a piece of artwork attached to a movie. The
+// image data itself lives in our storage backend under StorageKey; the database
+// only records where to find it and what it looks like.
+type MovieImage struct {
+	MovieID     int64     `json:"movie_id"`
+	Kind        string    `json:"kind"`
+	StorageKey  string    `json:"-"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Version     int32     `json:"version"`
+}
+
+// Get retrieves the image of the given kind for a movie
+func (m MovieImageModel) Get(movieID int64, kind string) (*MovieImage, error) {
+	if movieID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT movie_id, kind, storage_key, content_type, size, width, height, updated_at, version
+		FROM movie_images
+		WHERE movie_id = $1 AND kind = $2`
+
+	var image MovieImage
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, movieID, kind).Scan(
+		&image.MovieID,
+		&image.Kind,
+		&image.StorageKey,
+		&image.ContentType,
+		&image.Size,
+		&image.Width,
+		&image.Height,
+		&image.UpdatedAt,
+		&image.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &image, nil
+}
+
+// Upsert inserts the image record for a movie, or replaces the existing one if the
+// movie already has an image of the same kind. Each replacement bumps the version.
+func (m MovieImageModel) Upsert(image *MovieImage) error {
+	query := `
+		INSERT INTO movie_images (movie_id, kind, storage_key, content_type, size, width, height)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (movie_id, kind) DO UPDATE
+		SET storage_key = EXCLUDED.storage_key,
+			content_type = EXCLUDED.content_type,
+			size = EXCLUDED.size,
+			width = EXCLUDED.width,
+			height = EXCLUDED.height,
+			updated_at = NOW(),
+			version = movie_images.version + 1
+		RETURNING updated_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{
+		image.MovieID,
+		image.Kind,
+		image.StorageKey,
+		image.ContentType,
+		image.Size,
+		image.Width,
+		image.Height,
+	}
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&image.UpdatedAt, &image.Version)
+}
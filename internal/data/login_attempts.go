@@ -0,0 +1,221 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// LoginAttemptModel defines struct type which wraps a sql.DB connection pool
+type LoginAttemptModel struct {
+	DB *sql.DB
+}
+
+// LoginFailures summarizes the failed logins for an email address or IP address within a
+// window of time. First and Last are the zero time when Count is zero
+type LoginFailures struct {
+	Count int
+	First time.Time
+	Last  time.Time
+}
+
+// Lockout records that a user can't log in until LockedUntil, because of too many
+// failed login attempts
+type Lockout struct {
+	CreatedAt   time.Time `json:"created_at"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// RecordFailure records a failed login for the given email address from the given IP
+// address. The email address doesn't have to belong to a user, so that guessing at
+// unregistered addresses is slowed down in the same way
+func (m LoginAttemptModel) RecordFailure(email, ip string) error {
+	query := `
+		INSERT INTO login_attempts (email, ip)
+		VALUES ($1, $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email, ip)
+	return err
+}
+
+// FailuresForEmail summarizes the failed logins for an email address within the window
+func (m LoginAttemptModel) FailuresForEmail(email string, window time.Duration) (LoginFailures, error) {
+	return m.failures(`email = $1`, email, window)
+}
+
+// FailuresForIP summarizes the failed logins from an IP address within the window,
+// whichever email addresses they were for
+func (m LoginAttemptModel) FailuresForIP(ip string, window time.Duration) (LoginFailures, error) {
+	return m.failures(`ip = $1`, ip, window)
+}
+
+// failures summarizes the failed logins matching the given condition within the window
+func (m LoginAttemptModel) failures(condition string, arg any, window time.Duration) (LoginFailures, error) {
+	query := `
+		SELECT count(*), COALESCE(min(created_at), 'epoch'), COALESCE(max(created_at), 'epoch')
+		FROM login_attempts
+		WHERE ` + condition + ` AND created_at > $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var failures LoginFailures
+
+	err := m.DB.QueryRowContext(ctx, query, arg, time.Now().Add(-window)).Scan(&failures.Count, &failures.First, &failures.Last)
+	if err != nil {
+		return LoginFailures{}, err
+	}
+
+	if failures.Count == 0 {
+		return LoginFailures{}, nil
+	}
+
+	return failures, nil
+}
+
+// ClearForEmail forgets the failed logins for an email address, which we do once
+// somebody logs in successfully or the account is unlocked
+func (m LoginAttemptModel) ClearForEmail(email string) error {
+	query := `
+		DELETE FROM login_attempts
+		WHERE email = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email)
+	return err
+}
+
+// Lock stops a user from logging in until the given time. Locking a user who is already
+// locked moves the end of the lockout
+func (m LoginAttemptModel) Lock(userID int64, until time.Time) error {
+	query := `
+		INSERT INTO login_lockouts (user_id, locked_until)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET created_at = NOW(), locked_until = EXCLUDED.locked_until`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, until)
+	return err
+}
+
+// GetLock returns the user's current lockout, or nil if they aren't locked out. Lockouts
+// which have run out are ignored, even if they haven't been cleaned up yet
+func (m LoginAttemptModel) GetLock(userID int64) (*Lockout, error) {
+	query := `
+		SELECT created_at, locked_until
+		FROM login_lockouts
+		WHERE user_id = $1 AND locked_until > NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var lockout Lockout
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&lockout.CreatedAt, &lockout.LockedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &lockout, nil
+}
+
+// Unlock removes a user's lockout, returning ErrRecordNotFound if they weren't locked out
+func (m LoginAttemptModel) Unlock(userID int64) error {
+	query := `
+		DELETE FROM login_lockouts
+		WHERE user_id = $1 AND locked_until > NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// LockEmail stops anyone logging in with an email address which doesn't belong to a user
+// until the given time. Unregistered addresses are locked like accounts are, so that the
+// responses to guessing at them don't give away which addresses are registered
+func (m LoginAttemptModel) LockEmail(email string, until time.Time) error {
+	query := `
+		INSERT INTO login_email_lockouts (email, locked_until)
+		VALUES ($1, $2)
+		ON CONFLICT (email) DO UPDATE
+		SET created_at = NOW(), locked_until = EXCLUDED.locked_until`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email, until)
+	return err
+}
+
+// GetEmailLock returns the email address's current lockout, or nil if it isn't locked out
+func (m LoginAttemptModel) GetEmailLock(email string) (*Lockout, error) {
+	query := `
+		SELECT created_at, locked_until
+		FROM login_email_lockouts
+		WHERE email = $1 AND locked_until > NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var lockout Lockout
+
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(&lockout.CreatedAt, &lockout.LockedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return &lockout, nil
+}
+
+// DeleteExpired removes failed logins which are older than the window, along with any
+// lockouts which have run out. It's called periodically to stop the tables growing forever
+func (m LoginAttemptModel) DeleteExpired(window time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM login_attempts WHERE created_at <= $1`, time.Now().Add(-window))
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(ctx, `DELETE FROM login_lockouts WHERE locked_until <= NOW()`)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(ctx, `DELETE FROM login_email_lockouts WHERE locked_until <= NOW()`)
+	return err
+}
@@ -15,19 +15,51 @@ var (
 // Models struct which wraps around MovieModel struct. We'll add other models to this
 // like a UserModel and PermissionsModel
 type Models struct {
-	Movies      MovieModel
-	Users       UserModel
-	Tokens      TokenModel
-	Permissions PermissionsModel
+	Movies        MovieModel
+	Users         UserModel
+	Tokens        TokenModel
+	Permissions   PermissionsModel
+	Series        SeriesModel
+	Seasons       SeasonModel
+	Episodes      EpisodeModel
+	Search        SearchModel
+	Images        MovieImageModel
+	Translations  MovieTranslationModel
+	Collections   CollectionModel
+	Audit         AuditModel
+	Roles         RoleModel
+	LoginAttempts LoginAttemptModel
+	TwoFactor     TwoFactorModel
+	Denylist      DenylistModel
+	ApiKeys       ApiKeyModel
+	Identities    IdentityModel
+	OIDCStates    OIDCStateModel
+	EmailLimits   EmailLimitModel
 }
 
 // NewModels is a helper func that returns a Models struct containing
 // the initialized MoviesModel
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionsModel{DB: db},
+		Movies:        MovieModel{DB: db},
+		Users:         UserModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		Permissions:   PermissionsModel{DB: db},
+		Series:        SeriesModel{DB: db},
+		Seasons:       SeasonModel{DB: db},
+		Episodes:      EpisodeModel{DB: db},
+		Search:        SearchModel{DB: db},
+		Images:        MovieImageModel{DB: db},
+		Translations:  MovieTranslationModel{DB: db},
+		Collections:   CollectionModel{DB: db},
+		Audit:         AuditModel{DB: db},
+		Roles:         RoleModel{DB: db},
+		LoginAttempts: LoginAttemptModel{DB: db},
+		TwoFactor:     TwoFactorModel{DB: db},
+		Denylist:      DenylistModel{DB: db},
+		ApiKeys:       ApiKeyModel{DB: db},
+		Identities:    IdentityModel{DB: db},
+		OIDCStates:    OIDCStateModel{DB: db},
+		EmailLimits:   EmailLimitModel{DB: db},
 	}
 }
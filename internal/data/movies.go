@@ -3,6 +3,7 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/lib/pq"
@@ -19,8 +20,8 @@ type MovieModel struct {
 func (m MovieModel) Insert(movie *Movie) error {
 	// define sql query for inserting new movie records
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO movies (title, year, runtime, genres, synopsis, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
 		RETURNING id, created_at, version`
 
 	// create a context with a 3-second timeout
@@ -30,7 +31,7 @@ func (m MovieModel) Insert(movie *Movie) error {
 	// create an args slice containing the values for the placeholder params
 	// from the movie struct. Declaring this slice immediately next to our SQL query
 	// helps to make it nice and clear *what values are being used where* in the query.
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.Synopsis, movie.CreatedBy}
 
 	// use QueryRow() method to execute the SQL query on our local connection pool
 	// passing in the args slice as a variadic parameter and scanning the system
@@ -46,10 +47,10 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	}
 
 	// define sql query to read a record by its id
-	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
+	query := fmt.Sprintf(`
+		SELECT id, created_at, created_by, title, year, runtime, genres, synopsis, version, %s
 		FROM movies
-		WHERE id = $1`
+		WHERE id = $1`, externalIDsColumn)
 
 	var movie Movie
 
@@ -63,11 +64,14 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	err := m.DB.QueryRowContext(ctx, query, id).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
+		&movie.CreatedBy,
 		&movie.Title,
 		&movie.Year,
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
+		&movie.Synopsis,
 		&movie.Version,
+		&movie.ExternalIDs,
 	)
 
 	if err != nil {
@@ -82,22 +86,28 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	return &movie, nil
 }
 
-// GetAll retrieves all records from the movies table
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+// GetAll retrieves all records from the movies table. If collectionID is non-zero, only
+// the movies which belong to that collection are returned
+func (m MovieModel) GetAll(title string, genres []string, collectionID int64, filters Filters) ([]*Movie, Metadata, error) {
 	// define the SQL query
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+		SELECT count(*) OVER(), id, created_at, created_by, title, year, runtime, genres, synopsis, version, %s
 		FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) or $1 = '')
+		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1)
+			OR EXISTS (SELECT 1 FROM movie_translations
+				WHERE movie_translations.movie_id = movies.id
+				AND to_tsvector('simple', movie_translations.title) @@ plainto_tsquery('simple', $1))
+			OR $1 = '')
 		AND (genres @> $2 OR $2 = '{}')
+		AND (id IN (SELECT movie_id FROM collections_movies WHERE collection_id = $5) OR $5 = 0)
 		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		LIMIT $3 OFFSET $4`, externalIDsColumn, filters.sortColumn(), filters.sortDirection())
 
 	// create a context with a 3-second timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := []any{title, pq.Array(genres), filters.limit(), filters.offset(), collectionID}
 
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -125,11 +135,14 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&totalRecords,
 			&movie.ID,
 			&movie.CreatedAt,
+			&movie.CreatedBy,
 			&movie.Title,
 			&movie.Year,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
+			&movie.Synopsis,
 			&movie.Version,
+			&movie.ExternalIDs,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -159,8 +172,8 @@ func (m MovieModel) Update(movie *Movie) error {
 	// define the sql query to update a movie record
 	query := `
 		UPDATE movies
-		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET title = $1, year = $2, runtime = $3, genres = $4, synopsis = $5, version = version + 1
+		WHERE id = $6 AND version = $7
 		RETURNING version`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -173,6 +186,7 @@ func (m MovieModel) Update(movie *Movie) error {
 		movie.Year,
 		movie.Runtime,
 		pq.Array(movie.Genres),
+		movie.Synopsis,
 		movie.ID,
 		movie.Version,
 	}
@@ -227,14 +241,47 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
+// Movie struct holds the data for an individual movie. When a movie has been localized
+// (see MovieTranslationModel.Localize), Title and Synopsis hold the translated text,
+// Locale holds the locale of the translation and OriginalTitle holds the untranslated title.
 type Movie struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year"`
-	Runtime   Runtime   `json:"runtime"`
-	Genres    []string  `json:"genres"`
-	Version   int32     `json:"version"`
+	ID            int64       `json:"id"`
+	CreatedAt     time.Time   `json:"-"`
+	Title         string      `json:"title"`
+	OriginalTitle string      `json:"original_title,omitempty"`
+	Year          int32       `json:"year"`
+	Runtime       Runtime     `json:"runtime"`
+	Genres        []string    `json:"genres"`
+	Synopsis      string      `json:"synopsis,omitempty"`
+	Locale        string      `json:"locale,omitempty"`
+	ExternalIDs   ExternalIDs `json:"external_ids,omitempty"`
+	CreatedBy     *int64      `json:"created_by,omitempty"`
+	Version       int32       `json:"version"`
+
+	// RuntimeFormat controls how the runtime is written out in JSON, and is never stored
+	RuntimeFormat RuntimeFormat `json:"-"`
+}
+
+// IsCreatedBy reports whether the movie was added by the given user. Movies added before
+// we started recording this, or whose creator has been deleted, belong to nobody
+func (m *Movie) IsCreatedBy(userID int64) bool {
+	return m.CreatedBy != nil && *m.CreatedBy == userID
+}
+
+// MarshalJSON writes the movie out with its runtime in the requested RuntimeFormat. The
+// movieJSON alias has the same fields as Movie but none of its methods, which stops
+// json.Marshal from calling this method again. The outer Runtime field shadows the
+// embedded one, because encoding/json prefers the least nested field with a given name.
+func (m Movie) MarshalJSON() ([]byte, error) {
+	type movieJSON Movie
+
+	return json.Marshal(struct {
+		movieJSON
+		Runtime any `json:"runtime"`
+	}{
+		movieJSON: movieJSON(m),
+		Runtime:   m.Runtime.Format(m.RuntimeFormat),
+	})
 }
 
 // ValidateMovie function is used to run our validation checks on client user input.
@@ -243,6 +290,8 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(movie.Title != "", "title", "title must not be empty")
 	v.Check(len(movie.Title) <= 500, "title", "title must be less then 500 bytes long")
 
+	v.Check(len(movie.Synopsis) <= 10_000, "synopsis", "synopsis must be less then 10000 bytes long")
+
 	v.Check(movie.Year != 0, "year", "must provide a year")
 	v.Check(movie.Year >= 1888, "year", "year must be greater then 1888")
 	v.Check(movie.Year <= int32(time.Now().Year()), "year", "year cannot be in the future")
@@ -255,3 +304,81 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(len(movie.Genres) <= 5, "genres", "cannot contain more then 5 genres")
 	v.Check(validator.Unique(movie.Genres), "genres", "cannot contain duplicate genres")
 }
+
+// SimilarMovie holds a movie along with how similar it is to the movie the client
+// asked about, as a score between 0 and 1
+type SimilarMovie struct {
+	Movie *Movie  `json:"movie"`
+	Score float64 `json:"score"`
+}
+
+// GetSimilar retrieves the movies which are most similar to the movie with the given ID.
+// The scores are precomputed in the movie_similarity materialized view (see RefreshSimilar),
+// so this is a simple indexed lookup rather than a comparison against every other movie.
+func (m MovieModel) GetSimilar(id int64, filters Filters) ([]*SimilarMovie, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), movies.id, movies.created_at, movies.created_by, title, year, runtime, genres, synopsis, version, %s, score
+		FROM movie_similarity
+		INNER JOIN movies ON movies.id = movie_similarity.similar_movie_id
+		WHERE movie_similarity.movie_id = $1
+		ORDER BY %s %s, movies.id ASC
+		LIMIT $2 OFFSET $3`, externalIDsColumn, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, id, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	similar := []*SimilarMovie{}
+
+	for rows.Next() {
+		var movie Movie
+		var score float64
+
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.CreatedBy,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Synopsis,
+			&movie.Version,
+			&movie.ExternalIDs,
+			&score,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		similar = append(similar, &SimilarMovie{Movie: &movie, Score: score})
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return similar, metadata, nil
+}
+
+// RefreshSimilar recomputes the movie_similarity materialized view. Using CONCURRENTLY
+// means that readers can keep using the old scores while the new ones are calculated,
+// at the cost of a slower refresh. Because this compares every pair of movies it can
+// take a while, so we allow it a much longer timeout than our other queries.
+func (m MovieModel) RefreshSimilar() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `REFRESH MATERIALIZED VIEW CONCURRENTLY movie_similarity`)
+	return err
+}
@@ -0,0 +1,70 @@
+package data
+
+import (
+	"greenlight.twd.net/internal/passwords"
+	"greenlight.twd.net/internal/validator"
+	"strings"
+)
+
+// PasswordPolicy decides which new passwords are acceptable, beyond the length checks in
+// ValidatePassword. It only applies when a password is set, so users with passwords from
+// before the policy (or before it was tightened) can still log in with them.
+type PasswordPolicy struct {
+	// MinScore is the lowest strength score a password can have, from 0 to 4. See
+	// passwords.Score for what the scores mean
+	MinScore int
+
+	// Breached holds the hashes of passwords which have appeared in data breaches. It's
+	// nil when no corpus has been loaded, in which case nothing counts as breached
+	Breached *passwords.Corpus
+}
+
+// DefaultPasswordPolicy is the policy ValidateUser checks new passwords against. It's
+// replaced at startup with the policy from the command line flags
+var DefaultPasswordPolicy = PasswordPolicy{MinScore: 2}
+
+// Validate runs the policy's checks on a password which the user wants to set. The user's
+// name and email addresses are used to reject passwords built from them
+func (p PasswordPolicy) Validate(v *validator.Validator, password string, user *User) {
+	inputs := personalInputs(user)
+
+	lower := strings.ToLower(password)
+	for _, input := range inputs {
+		if strings.Contains(lower, input) {
+			v.AddError("password", "must not contain your name or email address")
+			return
+		}
+	}
+
+	v.Check(!p.Breached.Contains(password), "password", "has appeared in a data breach, please choose a different one")
+	v.Check(passwords.Score(password, inputs...) >= p.MinScore, "password", "is too easy to guess, try making it longer or using more unusual words")
+}
+
+// personalInputs returns the parts of the user's name and email addresses which are too
+// easy to guess to be used in their password. Very short parts are ignored, as they'd rule
+// out too many passwords by chance
+func personalInputs(user *User) []string {
+	var inputs []string
+
+	add := func(s string) {
+		s = strings.ToLower(s)
+		if len(s) >= 3 {
+			inputs = append(inputs, s)
+		}
+	}
+
+	for _, part := range strings.Fields(user.Name) {
+		add(part)
+	}
+
+	for _, email := range []string{user.Email, user.PendingEmail} {
+		local, _, _ := strings.Cut(email, "@")
+		add(local)
+
+		for _, part := range strings.FieldsFunc(local, func(r rune) bool { return strings.ContainsRune("._+-", r) }) {
+			add(part)
+		}
+	}
+
+	return inputs
+}
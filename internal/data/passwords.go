@@ -0,0 +1,193 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// ErrInvalidHash is returned when a stored password hash can't be decoded
+var (
+	ErrInvalidHash = errors.New("invalid password hash")
+)
+
+// PasswordHasher is implemented by each password hashing algorithm we support. Hashes are
+// stored as self-describing strings which include the algorithm and its parameters, so
+// that we can tell which hasher made a hash and whether it's been made with outdated
+// parameters.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of a plaintext password
+	Hash(plaintext string) ([]byte, error)
+
+	// Recognizes reports whether the encoded hash was made by this hasher's algorithm
+	Recognizes(hash []byte) bool
+
+	// Verify reports whether the plaintext password matches the encoded hash
+	Verify(hash []byte, plaintext string) (bool, error)
+
+	// NeedsRehash reports whether the encoded hash was made with different parameters to
+	// the ones the hasher currently uses
+	NeedsRehash(hash []byte) bool
+}
+
+// DefaultPasswordHasher is used to hash new passwords. The parameters are the ones OWASP
+// recommends for argon2id as a minimum, and can be raised over time: existing hashes are
+// upgraded the next time their users log in
+var DefaultPasswordHasher PasswordHasher = Argon2idHasher{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// legacyPasswordHashers can still verify hashes made before we switched to argon2id, but
+// aren't used to make new ones
+var legacyPasswordHashers = []PasswordHasher{
+	BcryptHasher{Cost: 12},
+}
+
+// passwordHasherFor returns the hasher which made the encoded hash
+func passwordHasherFor(hash []byte) (PasswordHasher, error) {
+	if DefaultPasswordHasher.Recognizes(hash) {
+		return DefaultPasswordHasher, nil
+	}
+
+	for _, hasher := range legacyPasswordHashers {
+		if hasher.Recognizes(hash) {
+			return hasher, nil
+		}
+	}
+
+	return nil, ErrInvalidHash
+}
+
+// Argon2idHasher hashes passwords with argon2id, encoding them in the PHC string format
+// like "$argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>". Memory is in KiB
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// argon2idPrefix starts every hash made by Argon2idHasher
+const argon2idPrefix = "$argon2id$"
+
+func (h Argon2idHasher) Hash(plaintext string) ([]byte, error) {
+	salt := make([]byte, h.SaltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintext), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	encoded := fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	return []byte(encoded), nil
+}
+
+func (h Argon2idHasher) Recognizes(hash []byte) bool {
+	return strings.HasPrefix(string(hash), argon2idPrefix)
+}
+
+func (h Argon2idHasher) Verify(hash []byte, plaintext string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(plaintext), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h Argon2idHasher) NeedsRehash(hash []byte) bool {
+	params, salt, _, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+
+	params.SaltLength = uint32(len(salt))
+
+	return params != h
+}
+
+// decodeArgon2id splits an encoded argon2id hash into its parameters, salt and key
+func decodeArgon2id(hash []byte) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, ErrInvalidHash
+	}
+
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+// BcryptHasher hashes passwords with bcrypt, which was the only algorithm we used before
+// argon2id. Bcrypt ignores everything after the first 72 bytes of a password, so it
+// refuses to hash anything longer
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(plaintext string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plaintext), h.Cost)
+}
+
+func (h BcryptHasher) Recognizes(hash []byte) bool {
+	return strings.HasPrefix(string(hash), "$2")
+}
+
+func (h BcryptHasher) Verify(hash []byte, plaintext string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(hash, []byte(plaintext))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (h BcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.Cost
+}
@@ -3,7 +3,12 @@ package data
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"github.com/lib/pq"
+	"greenlight.twd.net/internal/validator"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -11,24 +16,118 @@ import (
 // like ["movies:read", "movies:write"]
 type Permissions []string
 
-// Include is a helper method to check whether the Permissions slice contains
-// a specific permissions code
+// PermissionImplications lists the codes which are implied by other codes, so that a user
+// with the code on the left also has the codes on the right. Implied codes can have
+// implications of their own, so this mustn't contain any cycles
+var PermissionImplications = map[string][]string{
+	"movies:write":     {"movies:write:own"},
+	"movies:write:own": {"movies:read"},
+}
+
+// Include is a helper method to check whether the Permissions slice grants a specific
+// permission code. A code is granted if it's in the slice, if it's covered by a wildcard
+// like "movies:*" or "*", or if it's implied by one of the codes in the slice
 func (p Permissions) Include(code string) bool {
 	for i := range p {
-		if code == p[i] {
+		if grants(p[i], code) {
+			return true
+		}
+	}
+	return false
+}
+
+// IncludeAny checks whether the Permissions slice grants at least one of the codes
+func (p Permissions) IncludeAny(codes ...string) bool {
+	for _, code := range codes {
+		if p.Include(code) {
 			return true
 		}
 	}
 	return false
 }
 
+// IncludeAll checks whether the Permissions slice grants every one of the codes
+func (p Permissions) IncludeAll(codes ...string) bool {
+	for _, code := range codes {
+		if !p.Include(code) {
+			return false
+		}
+	}
+	return true
+}
+
+// Intersect returns the codes granted by both slices. A code from one slice is kept if the
+// other slice grants it, so a wildcard on one side is narrowed to the codes the other
+// side actually has
+func (p Permissions) Intersect(other Permissions) Permissions {
+	result := Permissions{}
+
+	for _, pair := range [][2]Permissions{{p, other}, {other, p}} {
+		for _, code := range pair[0] {
+			if pair[1].Include(code) && !slices.Contains(result, code) {
+				result = append(result, code)
+			}
+		}
+	}
+
+	return result
+}
+
+// grants reports whether the granted code covers the required code
+func grants(granted, code string) bool {
+	if granted == code || granted == "*" {
+		return true
+	}
+
+	// "movies:*" covers every code starting with "movies:"
+	if prefix, ok := strings.CutSuffix(granted, "*"); ok && strings.HasPrefix(code, prefix) {
+		return true
+	}
+
+	for _, implied := range PermissionImplications[granted] {
+		if grants(implied, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionCodeRX is a regular expression for sanity checking permission codes, which are
+// made up of lower case words separated by colons, like "movies:read". The last word can be
+// a wildcard, like "movies:*", and "*" on its own stands for every code
+var (
+	PermissionCodeRX = regexp.MustCompile(`^(\*|[a-z0-9_-]+(:[a-z0-9_-]+)*:([a-z0-9_-]+|\*))$`)
+)
+
+// ErrDuplicateCode is returned when creating a permission with a code which already exists
+var (
+	ErrDuplicateCode = errors.New("duplicate permission code")
+)
+
+// Permission holds the definition of a single permission code
+type Permission struct {
+	ID          int64  `json:"id"`
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+// ValidatePermission runs our validation checks on a permission definition
+func ValidatePermission(v *validator.Validator, permission *Permission) {
+	v.Check(permission.Code != "", "code", "must be provided")
+	v.Check(len(permission.Code) <= 100, "code", "must not be more than 100 bytes long")
+	v.Check(v.Matches(permission.Code, PermissionCodeRX), "code", "must be lower case words separated by colons, like movies:read or movies:*")
+
+	v.Check(len(permission.Description) <= 1000, "description", "must not be more than 1000 bytes long")
+}
+
 // PermissionsModel allows us to tap into it via the *sql.DB
 type PermissionsModel struct {
 	DB *sql.DB
 }
 
 // GetAllForUser method allows us to check what permissions a specific user has
-// we perform this check by the User ID
+// we perform this check by the User ID. The user's effective permissions are the union
+// of the codes granted to them directly and the codes of every role they have
 func (m PermissionsModel) GetAllForUser(userID int64) (Permissions, error) {
 
 	// define query
@@ -36,13 +135,54 @@ func (m PermissionsModel) GetAllForUser(userID int64) (Permissions, error) {
 		SELECT permissions.code
 		FROM permissions
 		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-		INNER JOIN users ON users_permissions.user_id = users.id
-		WHERE users.id = $1`
+		WHERE users_permissions.user_id = $1
+		UNION
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN role_permissions ON role_permissions.permission_id = permissions.id
+		INNER JOIN user_roles ON user_roles.role_id = role_permissions.role_id
+		WHERE user_roles.user_id = $1
+		ORDER BY code`
+
+	return m.queryCodes(query, userID)
+}
+
+// GetUserIDs returns the IDs of the users who have a permission code, whether it was granted
+// to them directly or they have it through one of their roles
+func (m PermissionsModel) GetUserIDs(permissionID int64) ([]int64, error) {
+	query := `
+		SELECT user_id
+		FROM users_permissions
+		WHERE permission_id = $1
+		UNION
+		SELECT user_roles.user_id
+		FROM user_roles
+		INNER JOIN role_permissions ON role_permissions.role_id = user_roles.role_id
+		WHERE role_permissions.permission_id = $1
+		ORDER BY user_id`
+
+	return queryIDs(m.DB, query, permissionID)
+}
+
+// GetDirectForUser returns only the permission codes granted to a user directly,
+// ignoring the codes they have through their roles
+func (m PermissionsModel) GetDirectForUser(userID int64) (Permissions, error) {
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1
+		ORDER BY permissions.code`
 
+	return m.queryCodes(query, userID)
+}
+
+// queryCodes runs a query which returns a single column of permission codes
+func (m PermissionsModel) queryCodes(query string, args ...any) (Permissions, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, userID)
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -75,7 +215,25 @@ func (m PermissionsModel) AddForUser(userID int64, codes ...string) error {
 	// define our query
 	query := `
 		INSERT INTO users_permissions
-		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+// RemoveForUser revokes the given permission codes from a user. Codes which the user
+// doesn't have are ignored
+func (m PermissionsModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+		DELETE FROM users_permissions
+		USING permissions
+		WHERE users_permissions.permission_id = permissions.id
+		AND users_permissions.user_id = $1
+		AND permissions.code = ANY($2)`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -83,3 +241,149 @@ func (m PermissionsModel) AddForUser(userID int64, codes ...string) error {
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
 	return err
 }
+
+// GetAll retrieves every permission code which has been defined, ordered by code
+func (m PermissionsModel) GetAll() ([]*Permission, error) {
+	query := `
+		SELECT id, code, description
+		FROM permissions
+		ORDER BY code ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	permissions := []*Permission{}
+
+	for rows.Next() {
+		var permission Permission
+
+		err := rows.Scan(&permission.ID, &permission.Code, &permission.Description)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, &permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// Get retrieves a permission definition by its ID
+func (m PermissionsModel) Get(id int64) (*Permission, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, code, description
+		FROM permissions
+		WHERE id = $1`
+
+	var permission Permission
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&permission.ID, &permission.Code, &permission.Description)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &permission, nil
+}
+
+// Insert defines a new permission code
+func (m PermissionsModel) Insert(permission *Permission) error {
+	query := `
+		INSERT INTO permissions (code, description)
+		VALUES ($1, $2)
+		RETURNING id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, permission.Code, permission.Description).Scan(&permission.ID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "permissions_code_key"`:
+			return ErrDuplicateCode
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Update changes the description of a permission. Codes are referenced throughout the
+// application (see routes.go), so they can't be renamed
+func (m PermissionsModel) Update(permission *Permission) error {
+	query := `
+		UPDATE permissions
+		SET description = $1
+		WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, permission.Description, permission.ID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Delete removes a permission code. It's revoked from every user who had been granted
+// it, by the ON DELETE CASCADE constraint on users_permissions
+func (m PermissionsModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM permissions
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
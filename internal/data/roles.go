@@ -0,0 +1,409 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"greenlight.twd.net/internal/validator"
+	"regexp"
+	"time"
+)
+
+// RoleNameRX is a regular expression for sanity checking role names, like "editor"
+var (
+	RoleNameRX = regexp.MustCompile(`^[a-z0-9_-]+$`)
+)
+
+// ErrDuplicateRole is returned when creating or renaming a role to a name which is already taken
+var (
+	ErrDuplicateRole = errors.New("duplicate role name")
+)
+
+// RoleModel defines struct type which wraps a sql.DB connection pool
+type RoleModel struct {
+	DB *sql.DB
+}
+
+// Role is a named bundle of permission codes. Users with a role get all of its permissions
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// ValidateRole runs our validation checks on a role
+func ValidateRole(v *validator.Validator, role *Role) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(v.Matches(role.Name, RoleNameRX), "name", "must only contain lower case letters, digits, dashes and underscores")
+
+	v.Check(len(role.Description) <= 1000, "description", "must not be more than 1000 bytes long")
+
+	v.Check(role.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// roleColumns is the list of columns selected by every query which returns roles. The
+// permission codes are aggregated into an array, which is empty for a role without any
+const roleColumns = `roles.id, roles.name, roles.description,
+	ARRAY(SELECT permissions.code FROM permissions
+		INNER JOIN role_permissions ON role_permissions.permission_id = permissions.id
+		WHERE role_permissions.role_id = roles.id ORDER BY permissions.code)`
+
+// scanRole scans a row selected with roleColumns into a Role
+func scanRole(row interface{ Scan(...any) error }) (*Role, error) {
+	var role Role
+
+	err := row.Scan(&role.ID, &role.Name, &role.Description, pq.Array(&role.Permissions))
+	if err != nil {
+		return nil, err
+	}
+
+	return &role, nil
+}
+
+// GetAll retrieves every role, ordered by name
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `SELECT ` + roleColumns + ` FROM roles ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// Get retrieves a role by its ID
+func (m RoleModel) Get(id int64) (*Role, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	return m.getWhere(`roles.id = $1`, id)
+}
+
+// GetByName retrieves a role by its name
+func (m RoleModel) GetByName(name string) (*Role, error) {
+	return m.getWhere(`roles.name = $1`, name)
+}
+
+// getWhere retrieves the single role matching the given condition
+func (m RoleModel) getWhere(condition string, arg any) (*Role, error) {
+	query := `SELECT ` + roleColumns + ` FROM roles WHERE ` + condition
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	role, err := scanRole(m.DB.QueryRowContext(ctx, query, arg))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return role, nil
+}
+
+// setPermissions replaces the permission codes of a role inside the given transaction,
+// returning ErrRecordNotFound if any of the codes haven't been defined
+func setPermissions(ctx context.Context, tx *sql.Tx, roleID int64, codes []string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM role_permissions WHERE role_id = $1`, roleID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO role_permissions (role_id, permission_id)
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+
+	result, err := tx.ExecContext(ctx, query, roleID, pq.Array(codes))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected != int64(len(codes)) {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Insert creates a new role along with its permissions. ErrRecordNotFound is returned if
+// any of the permission codes don't exist
+func (m RoleModel) Insert(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO roles (name, description)
+		VALUES ($1, $2)
+		RETURNING id`
+
+	err = tx.QueryRowContext(ctx, query, role.Name, role.Description).Scan(&role.ID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRole
+		default:
+			return err
+		}
+	}
+
+	err = setPermissions(ctx, tx, role.ID, role.Permissions)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Update changes the name and description of a role and replaces its permissions. As with
+// Insert, ErrRecordNotFound is returned if any of the permission codes don't exist
+func (m RoleModel) Update(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+		UPDATE roles
+		SET name = $1, description = $2
+		WHERE id = $3`
+
+	_, err = tx.ExecContext(ctx, query, role.Name, role.Description, role.ID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRole
+		default:
+			return err
+		}
+	}
+
+	err = setPermissions(ctx, tx, role.ID, role.Permissions)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes a role. Users who had the role lose its permissions, unless they
+// have them some other way
+func (m RoleModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM roles
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetUserIDs returns the IDs of the users who have the role
+func (m RoleModel) GetUserIDs(roleID int64) ([]int64, error) {
+	query := `
+		SELECT user_id
+		FROM user_roles
+		WHERE role_id = $1
+		ORDER BY user_id`
+
+	return queryIDs(m.DB, query, roleID)
+}
+
+// queryIDs runs a query which selects a single column of IDs, and returns them
+func queryIDs(db *sql.DB, query string, args ...any) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ids := []int64{}
+
+	for rows.Next() {
+		var id int64
+
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// GetAllForUser returns the names of the roles a user has, ordered by name
+func (m RoleModel) GetAllForUser(userID int64) ([]string, error) {
+	query := `
+		SELECT roles.name
+		FROM roles
+		INNER JOIN user_roles ON user_roles.role_id = roles.id
+		WHERE user_roles.user_id = $1
+		ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	names := []string{}
+
+	for rows.Next() {
+		var name string
+
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// AddForUser gives a user the named roles. Roles the user already has are skipped, and
+// ErrRecordNotFound is returned if any of the roles don't exist
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var found int
+
+	err = tx.QueryRowContext(ctx, `SELECT count(*) FROM roles WHERE name = ANY($1)`, pq.Array(names)).Scan(&found)
+	if err != nil {
+		return err
+	}
+
+	if found != len(names) {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		INSERT INTO user_roles (user_id, role_id)
+		SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	_, err = tx.ExecContext(ctx, query, userID, pq.Array(names))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RemoveForUser takes the named role away from a user, returning ErrRecordNotFound if
+// the user didn't have it
+func (m RoleModel) RemoveForUser(userID int64, name string) error {
+	query := `
+		DELETE FROM user_roles
+		USING roles
+		WHERE user_roles.role_id = roles.id
+		AND user_roles.user_id = $1
+		AND roles.name = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, name)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
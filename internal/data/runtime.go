@@ -3,20 +3,85 @@ package data
 import (
 	"errors"
 	"fmt"
+	"math"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
 // ErrInvalidRuntimeFormat define an error that our UnmarshalJSON method can return if we're unable to parse
-// or convert the JSON string successfully
+// or convert the JSON string successfully. The errors returned by UnmarshalJSON are now *RuntimeFormatError
+// values which wrap this, so errors.Is(err, ErrInvalidRuntimeFormat) still works
 var ErrInvalidRuntimeFormat = errors.New("invalid runtime format")
 
-// Runtime Declare a custom runtime type, which has the underlying type int32
+// runtimeHint is appended to parse error messages to show clients what we accept
+const runtimeHint = `like 102, "102 mins", "1h 42m" or "PT1H42M"`
+
+// Regular expressions for the string formats a runtime can be written in. They're all
+// matched case-insensitively, against a string with the surrounding whitespace trimmed.
+var (
+	runtimeMinsRX  = regexp.MustCompile(`(?i)^(\d+)(?:\s*(?:mins?|minutes?))?$`)
+	runtimeHoursRX = regexp.MustCompile(`(?i)^(?:(\d+)\s*h)?\s*(?:(\d+)\s*m)?$`)
+	runtimeISORX   = regexp.MustCompile(`(?i)^PT(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?$`)
+)
+
+// RuntimeFormatError is returned by UnmarshalJSON when a runtime can't be parsed. The
+// Message is written to be shown to clients as a validation error for the runtime field.
+type RuntimeFormatError struct {
+	Value   string
+	Message string
+}
+
+func (e *RuntimeFormatError) Error() string {
+	return fmt.Sprintf("invalid runtime %s: %s", e.Value, e.Message)
+}
+
+// Unwrap lets errors.Is() match a RuntimeFormatError against ErrInvalidRuntimeFormat
+func (e *RuntimeFormatError) Unwrap() error {
+	return ErrInvalidRuntimeFormat
+}
+
+// RuntimeFormat is one of the representations we can write a runtime out in
+type RuntimeFormat string
+
+// The supported runtime formats. RuntimeFormatMins is the default, and an empty
+// RuntimeFormat is treated in the same way
+const (
+	RuntimeFormatMins    RuntimeFormat = "mins"
+	RuntimeFormatISO8601 RuntimeFormat = "iso8601"
+	RuntimeFormatSeconds RuntimeFormat = "seconds"
+)
+
+// RuntimeFormats lists every supported runtime format, for use with validator.PermittedValue
+var RuntimeFormats = []RuntimeFormat{RuntimeFormatMins, RuntimeFormatISO8601, RuntimeFormatSeconds}
+
+// Runtime Declare a custom runtime type, which has the underlying type int32. It holds a number of minutes
 type Runtime int32
 
+// Format returns the runtime in the given format, as a value ready to be encoded as JSON.
+// That's a string for the mins and iso8601 formats, and a number for seconds
+func (r Runtime) Format(format RuntimeFormat) any {
+	switch format {
+	case RuntimeFormatISO8601:
+		hours, minutes := r/60, r%60
+		switch {
+		case hours == 0:
+			return fmt.Sprintf("PT%dM", minutes)
+		case minutes == 0:
+			return fmt.Sprintf("PT%dH", hours)
+		default:
+			return fmt.Sprintf("PT%dH%dM", hours, minutes)
+		}
+	case RuntimeFormatSeconds:
+		return int64(r) * 60
+	default:
+		return fmt.Sprintf("%d mins", r)
+	}
+}
+
 // MarshalJSON Implement a MarshalJSON() method on the Runtime type so that it satisfies the json.Marshal interface
 // this should return the json-encoded value for the movie runtime (in our case it will return a string in the format
-// "<runtime> mins").
+// "<runtime> mins"). Movies and episodes can ask for a different format, see Movie.MarshalJSON
 func (r Runtime) MarshalJSON() ([]byte, error) {
 	// Generate a string containing the move runtime in the required format
 	jsonValue := fmt.Sprintf("%d mins", r)
@@ -31,32 +96,99 @@ func (r Runtime) MarshalJSON() ([]byte, error) {
 // UnmarshalJSON method on the Runtime type so that it satisfies the json.Unmarshaler interface.
 // IMPORTANT: Because UnmarshalJSON() needs to modify the receiver (our Runtime type), we must
 // use a pointer receiver for this to work correctly. Otherwise, we wil only be modifying a copy
-// which is then discarded when this method returns
+// which is then discarded when this method returns.
+//
+// We accept a plain JSON integer number of minutes, or a string in any of the formats
+// understood by ParseRuntime
 func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
-	// We expect the incoming JSON value will be a sring in the format
-	// "<runtime> mins", and the first thing we need to do is remove the surrounding
-	// double quotes from this string. If we can't unquote it, then we return the
-	// ErrInvalidRuntimeFormat error
-	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
-	if err != nil {
-		return ErrInvalidRuntimeFormat
+	value := string(jsonValue)
+
+	// by convention a JSON null is a no-op, like it is for the built-in types
+	if value == "null" {
+		return nil
 	}
 
-	// Split the string to isolate the part containing the number
-	parts := strings.Split(unquotedJSONValue, " ")
+	// anything that isn't a string should be a number of minutes
+	if !strings.HasPrefix(value, `"`) {
+		i, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return &RuntimeFormatError{Value: value, Message: "must be a whole number of minutes, " + runtimeHint}
+		}
+		*r = Runtime(i)
+		return nil
+	}
 
-	// Sanity check the parts of the string to make sure it was in the expected format.
-	// if it isn't, we return the ErrInvalidRuntimeFormat error again
-	if len(parts) != 2 || parts[1] != "mins" {
-		return ErrInvalidRuntimeFormat
+	unquotedJSONValue, err := strconv.Unquote(value)
+	if err != nil {
+		return &RuntimeFormatError{Value: value, Message: "must be a valid JSON string"}
 	}
 
-	// Otherwise, parse the string containing the number into an int32. Again, if this fails
-	// return ErrInvalidRuntimeFormat error
-	i, err := strconv.ParseInt(parts[0], 10, 32)
+	runtime, err := ParseRuntime(unquotedJSONValue)
 	if err != nil {
-		return ErrInvalidRuntimeFormat
+		return err
 	}
-	*r = Runtime(i)
+
+	*r = runtime
 	return nil
 }
+
+// ParseRuntime parses a runtime written as "102", "102 mins", "1h 42m" (either part can be
+// left out) or an ISO 8601 duration like "PT1H42M". ISO 8601 durations may include seconds,
+// so long as they add up to a whole number of minutes.
+func ParseRuntime(s string) (Runtime, error) {
+	s = strings.TrimSpace(s)
+
+	invalid := func(message string) error {
+		return &RuntimeFormatError{Value: strconv.Quote(s), Message: message}
+	}
+
+	var hours, minutes, seconds string
+
+	switch {
+	case runtimeMinsRX.MatchString(s):
+		minutes = runtimeMinsRX.FindStringSubmatch(s)[1]
+
+	case runtimeISORX.MatchString(s):
+		matches := runtimeISORX.FindStringSubmatch(s)
+		hours, minutes, seconds = matches[1], matches[2], matches[3]
+
+		if hours == "" && minutes == "" && seconds == "" {
+			return 0, invalid("must include at least one of hours, minutes or seconds, like PT1H42M")
+		}
+
+	case s != "" && runtimeHoursRX.MatchString(s):
+		matches := runtimeHoursRX.FindStringSubmatch(s)
+		hours, minutes = matches[1], matches[2]
+
+	default:
+		return 0, invalid("must be a number of minutes, " + runtimeHint)
+	}
+
+	// add up the parts in seconds, using an int64 so that we can spot overflows
+	var total int64
+
+	for _, part := range []struct {
+		value  string
+		factor int64
+	}{{hours, 3600}, {minutes, 60}, {seconds, 1}} {
+		if part.value == "" {
+			continue
+		}
+
+		n, err := strconv.ParseInt(part.value, 10, 32)
+		if err != nil {
+			return 0, invalid("is too long")
+		}
+		total += n * part.factor
+	}
+
+	if total%60 != 0 {
+		return 0, invalid("must be a whole number of minutes")
+	}
+
+	if total/60 > math.MaxInt32 {
+		return 0, invalid("is too long")
+	}
+
+	return Runtime(total / 60), nil
+}
@@ -0,0 +1,94 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"time"
+)
+
+// Kinds of title that can be returned by a search
+const (
+	KindMovie  = "movie"
+	KindSeries = "series"
+)
+
+// SearchModel defines struct type which wraps a sql.DB connection pool. It doesn't
+// own a table of its own, instead it searches across the movies and series tables
+type SearchModel struct {
+	DB *sql.DB
+}
+
+// SearchResult holds a single search hit. The Kind field tells the client which
+// resource the ID belongs to, so they can follow up with /v1/movies/:id or /v1/series/:id
+type SearchResult struct {
+	Kind   string   `json:"kind"`
+	ID     int64    `json:"id"`
+	Title  string   `json:"title"`
+	Year   int32    `json:"year"`
+	Genres []string `json:"genres"`
+}
+
+// Search runs a full-text title search over both movies and series, returning a
+// single paginated list. Note that both halves of the UNION use the same
+// to_tsvector('simple', title) expression as MovieModel.GetAll(), so the existing
+// GIN indexes on each table are used.
+func (m SearchModel) Search(title string, filters Filters) ([]*SearchResult, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), kind, id, title, year, genres
+		FROM (
+			SELECT '%s' AS kind, id, title, year, genres
+			FROM movies
+			WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1)
+				OR EXISTS (SELECT 1 FROM movie_translations
+					WHERE movie_translations.movie_id = movies.id
+					AND to_tsvector('simple', movie_translations.title) @@ plainto_tsquery('simple', $1))
+				OR $1 = '')
+			UNION ALL
+			SELECT '%s' AS kind, id, title, year, genres
+			FROM series
+			WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) or $1 = '')
+		) AS titles
+		ORDER BY %s %s, kind ASC, id ASC
+		LIMIT $2 OFFSET $3`, KindMovie, KindSeries, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, title, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	results := []*SearchResult{}
+
+	for rows.Next() {
+		var result SearchResult
+
+		err := rows.Scan(
+			&totalRecords,
+			&result.Kind,
+			&result.ID,
+			&result.Title,
+			&result.Year,
+			pq.Array(&result.Genres),
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		results = append(results, &result)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return results, metadata, nil
+}
@@ -0,0 +1,214 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"greenlight.twd.net/internal/validator"
+	"time"
+)
+
+// ErrDuplicateNumber is returned when a season or episode number is already in use
+// within its parent series or season
+var (
+	ErrDuplicateNumber = errors.New("duplicate number")
+)
+
+// SeasonModel defines struct type which wraps a sql.DB connection pool
+type SeasonModel struct {
+	DB *sql.DB
+}
+
+// Season struct holds the data for a single season of a series. Seasons are
+// identified within their series by Number; season 0 is conventionally used for specials.
+type Season struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	SeriesID  int64     `json:"series_id"`
+	Number    int32     `json:"number"`
+	Title     string    `json:"title,omitempty"`
+	Year      int32     `json:"year"`
+	Version   int32     `json:"version"`
+}
+
+// ValidateSeason runs our validation checks on a season
+func ValidateSeason(v *validator.Validator, season *Season) {
+	v.Check(season.Number >= 0, "number", "must not be negative")
+
+	v.Check(len(season.Title) <= 500, "title", "title must be less then 500 bytes long")
+
+	v.Check(season.Year != 0, "year", "must provide a year")
+	v.Check(season.Year >= 1888, "year", "year must be greater then 1888")
+	v.Check(season.Year <= int32(time.Now().Year()), "year", "year cannot be in the future")
+}
+
+// Insert inserts a new record into the seasons table
+func (m SeasonModel) Insert(season *Season) error {
+	query := `
+		INSERT INTO seasons (series_id, number, title, year)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{season.SeriesID, season.Number, season.Title, season.Year}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&season.ID, &season.CreatedAt, &season.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "seasons_series_id_number_key"`:
+			return ErrDuplicateNumber
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// GetByNumber retrieves a season by its number within the given series
+func (m SeasonModel) GetByNumber(seriesID int64, number int32) (*Season, error) {
+	if seriesID < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, series_id, number, title, year, version
+		FROM seasons
+		WHERE series_id = $1 AND number = $2`
+
+	var season Season
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, seriesID, number).Scan(
+		&season.ID,
+		&season.CreatedAt,
+		&season.SeriesID,
+		&season.Number,
+		&season.Title,
+		&season.Year,
+		&season.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &season, nil
+}
+
+// GetAllForSeries retrieves every season of a series, ordered by season number
+func (m SeasonModel) GetAllForSeries(seriesID int64) ([]*Season, error) {
+	query := `
+		SELECT id, created_at, series_id, number, title, year, version
+		FROM seasons
+		WHERE series_id = $1
+		ORDER BY number ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, seriesID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	seasons := []*Season{}
+
+	for rows.Next() {
+		var season Season
+
+		err := rows.Scan(
+			&season.ID,
+			&season.CreatedAt,
+			&season.SeriesID,
+			&season.Number,
+			&season.Title,
+			&season.Year,
+			&season.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		seasons = append(seasons, &season)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return seasons, nil
+}
+
+// Update updates an existing record in the seasons table, using the version
+// field to guard against edit conflicts
+func (m SeasonModel) Update(season *Season) error {
+	query := `
+		UPDATE seasons
+		SET number = $1, title = $2, year = $3, version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{
+		season.Number,
+		season.Title,
+		season.Year,
+		season.ID,
+		season.Version,
+	}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&season.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "seasons_series_id_number_key"`:
+			return ErrDuplicateNumber
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes a record from the seasons table by its ID, along with its episodes
+func (m SeasonModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM seasons
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"greenlight.twd.net/internal/validator"
+	"time"
+)
+
+// SeriesModel defines struct type which wraps a sql.DB connection pool
+type SeriesModel struct {
+	DB *sql.DB
+}
+
+// Series struct holds the data for an individual TV show. The Year field is the
+// year the show first aired.
+type Series struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Title     string    `json:"title"`
+	Year      int32     `json:"year"`
+	Genres    []string  `json:"genres"`
+	Version   int32     `json:"version"`
+}
+
+// ValidateSeries runs our validation checks on a series. These mirror the checks we
+// run against movies, minus the runtime which lives on the individual episodes
+func ValidateSeries(v *validator.Validator, series *Series) {
+	v.Check(series.Title != "", "title", "title must not be empty")
+	v.Check(len(series.Title) <= 500, "title", "title must be less then 500 bytes long")
+
+	v.Check(series.Year != 0, "year", "must provide a year")
+	v.Check(series.Year >= 1888, "year", "year must be greater then 1888")
+	v.Check(series.Year <= int32(time.Now().Year()), "year", "year cannot be in the future")
+
+	v.Check(series.Genres != nil, "genres", "genres must be provided")
+	v.Check(len(series.Genres) >= 1, "genres", "must contain at least 1 genre")
+	v.Check(len(series.Genres) <= 5, "genres", "cannot contain more then 5 genres")
+	v.Check(validator.Unique(series.Genres), "genres", "cannot contain duplicate genres")
+}
+
+// Insert inserts a new record into the series table
+func (m SeriesModel) Insert(series *Series) error {
+	query := `
+		INSERT INTO series (title, year, genres)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{series.Title, series.Year, pq.Array(series.Genres)}
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&series.ID, &series.CreatedAt, &series.Version)
+}
+
+// Get a record from the series table by its ID
+func (m SeriesModel) Get(id int64) (*Series, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, title, year, genres, version
+		FROM series
+		WHERE id = $1`
+
+	var series Series
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&series.ID,
+		&series.CreatedAt,
+		&series.Title,
+		&series.Year,
+		pq.Array(&series.Genres),
+		&series.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &series, nil
+}
+
+// GetAll retrieves all records from the series table, filtered and paginated the
+// same way as MovieModel.GetAll
+func (m SeriesModel) GetAll(title string, genres []string, filters Filters) ([]*Series, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, title, year, genres, version
+		FROM series
+		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) or $1 = '')
+		AND (genres @> $2 OR $2 = '{}')
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	allSeries := []*Series{}
+
+	for rows.Next() {
+		var series Series
+
+		err := rows.Scan(
+			&totalRecords,
+			&series.ID,
+			&series.CreatedAt,
+			&series.Title,
+			&series.Year,
+			pq.Array(&series.Genres),
+			&series.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		allSeries = append(allSeries, &series)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return allSeries, metadata, nil
+}
+
+// Update updates an existing record in the series table, using the version
+// field to guard against edit conflicts
+func (m SeriesModel) Update(series *Series) error {
+	query := `
+		UPDATE series
+		SET title = $1, year = $2, genres = $3, version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{
+		series.Title,
+		series.Year,
+		pq.Array(series.Genres),
+		series.ID,
+		series.Version,
+	}
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&series.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes a record from the series table by its ID. Seasons and episodes
+// belonging to the series are removed by the ON DELETE CASCADE constraints
+func (m SeriesModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM series
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
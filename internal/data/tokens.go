@@ -6,30 +6,121 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
 	"greenlight.twd.net/internal/validator"
+	"hash/crc32"
+	"regexp"
+	"strings"
 	"time"
 )
 
+// ErrTokenReused is returned when a refresh token which has already been exchanged is
+// presented again. That means it has been copied, so the whole family is revoked
+var (
+	ErrTokenReused = errors.New("refresh token reused")
+)
+
 type TokenModel struct {
 	DB *sql.DB
 }
 
-// ScopeActivation Defines constants for the token scope. For now, we just define the scope 'activation'
-// but we'll add additional scopes later in the book
+// ScopeActivation Defines constants for the token scope. Password reset tokens are
+// emailed to users who have forgotten their password, and can be exchanged for a new one.
+// Email change tokens are sent to the new address when a user changes their email, to
+// confirm that they can receive mail there. Two-factor pending tokens are given to users
+// with 2FA turned on when they log in with their password, and are exchanged for an
+// authentication token along with a valid code. Login tokens are emailed as magic links, and
+// are exchanged for an authentication token without a password. Refresh tokens are long-lived, and are
+// exchanged for a new short-lived authentication token and a new refresh token
 const (
-	ScopeActivation     = "activation"
-	ScopeAuthentication = "authentication"
+	ScopeActivation       = "activation"
+	ScopeAuthentication   = "authentication"
+	ScopeRefresh          = "refresh"
+	ScopePasswordReset    = "password-reset"
+	ScopeEmailChange      = "email-change"
+	ScopeTwoFactorPending = "2fa-pending"
+	ScopeLogin            = "login"
 )
 
 // Token struct will hold the data for an individual token. This includes the
 // plaintext and hashed versions of the token, associated user ID, expiry time
-// and scope.
+// and scope. Authentication tokens also record the user agent and IP address of
+// the client which logged in with them. Tokens issued together when logging in, and every
+// pair which replaces them when refreshing, share a family, which is one session.
 type Token struct {
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	UserAgent string    `json:"-"`
+	IP        string    `json:"-"`
+	Family    int64     `json:"-"`
+}
+
+// Session describes a token family without giving the tokens themselves away, so that users
+// can see where they're logged in. The ID is the family, CreatedAt is when the user logged
+// in and Expiry is when the session ends unless it's refreshed. Current is true for the
+// session the request listing the sessions was made with
+type Session struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Expiry     time.Time `json:"expiry"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
+}
+
+// sessionTouchInterval is how out of date a token's last_used_at is allowed to get. Only
+// recording use once in a while saves a write to the tokens table on almost every request
+const sessionTouchInterval = time.Minute
+
+// Tokens look like glt_act_<random>_<checksum>, so that secret scanners can recognise them
+// and tell what they're for. The second part is a short code for the token's scope, and the
+// checksum is the CRC-32 of everything before it, in hex. The checksum isn't a security
+// measure, it just lets us and the scanners reject mistyped or made up tokens cheaply
+const secretPrefix = "glt"
+
+// tokenScopeCodes are the short codes for each token scope used in the token format
+var tokenScopeCodes = map[string]string{
+	ScopeActivation:       "act",
+	ScopeAuthentication:   "auth",
+	ScopeRefresh:          "ref",
+	ScopePasswordReset:    "pwr",
+	ScopeEmailChange:      "eml",
+	ScopeTwoFactorPending: "2fa",
+	ScopeLogin:            "lgn",
+}
+
+// secretRX matches the token format, capturing the scope code, random part and checksum
+var secretRX = regexp.MustCompile(`^` + secretPrefix + `_([a-z0-9]+)_([a-z2-7]+)_([0-9a-f]{8})$`)
+
+// legacyTokenRX matches tokens issued before the current format
+var legacyTokenRX = regexp.MustCompile(`^[A-Z2-7]{26}$`)
+
+// formatSecret puts a random string into the token format with the given scope code
+func formatSecret(code, random string) string {
+	body := secretPrefix + "_" + code + "_" + random
+	return fmt.Sprintf("%s_%08x", body, crc32.ChecksumIEEE([]byte(body)))
+}
+
+// parseSecret checks that a string is in the token format with a correct checksum,
+// returning its scope code
+func parseSecret(plaintext string) (string, bool) {
+	matches := secretRX.FindStringSubmatch(plaintext)
+	if matches == nil {
+		return "", false
+	}
+
+	body := plaintext[:len(plaintext)-len(matches[3])-1]
+	if fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(body))) != matches[3] {
+		return "", false
+	}
+
+	return matches[1], true
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -55,16 +146,17 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 		return nil, err
 	}
 
-	// Encode the byte slice to a base-32-encoded string and assign it to the token
-	// Plaintext field. This will be a token string that we send to the user in their welcome email.
-	// This will look similar to:
+	// Encode the byte slice to a base-32-encoded string, and wrap it up in our token format
+	// along with the scope and a checksum. This will be a token string that we send to the
+	// user in their welcome email. This will look similar to:
 	//
-	// Y3QMGX3PJ3WLRL2YRTQGQ6KRHU
+	// glt_act_y3qmgx3pj3wlrl2yrtqgq6krhu_1c291ca3
 	//
 	// Note that by default base-32 strings may be padded at the end with the = character
 	// We don't need this padding character for the purpose of our tokens, so we use
 	// WithPadding(base32.NoPadding) method in the line below
-	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	random := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	token.Plaintext = formatSecret(tokenScopeCodes[scope], random)
 
 	// Generate SHA-256 hash of the plaintext token string. This will be the value
 	// that we store in the `hash` field of our database table. Note that the
@@ -77,10 +169,20 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	return token, nil
 }
 
-// ValidateToken Check that the plaintext token has been provided and is exactly 26 bytes long
-func ValidateToken(v *validator.Validator, tokenPlainText string) {
+// ValidateToken checks that the plaintext token has been provided, and that it's a well formed
+// token for the given scope with a correct checksum, so that tokens which can't be right are
+// turned away without a database lookup. Tokens issued before the current format, which are
+// 26 bytes of upper case base32, are accepted until they've all expired
+func ValidateToken(v *validator.Validator, scope string, tokenPlainText string) {
 	v.Check(tokenPlainText != "", "token", "must be provided")
-	v.Check(len(tokenPlainText) == 26, "token", "must be 26 bytes long")
+
+	if legacyTokenRX.MatchString(tokenPlainText) {
+		return
+	}
+
+	code, ok := parseSecret(tokenPlainText)
+	v.Check(ok, "token", "must be a valid token")
+	v.Check(!ok || code == tokenScopeCodes[scope], "token", "must be a token with the "+scope+" scope")
 }
 
 // New method is a shortcut which creates a new Token struct and then inserts the data into the tokens table
@@ -98,25 +200,194 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
-// Insert creates new record in tokens table
-func (m TokenModel) Insert(token *Token) error {
-	// define query
+// NewSession creates a new authentication token and refresh token for a user who has just
+// logged in, recording the user agent and IP address of their client. Both tokens start a
+// new family. A zero accessTTL skips the authentication token, for when the caller issues
+// a signed access token instead
+func (m TokenModel) NewSession(userID int64, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer tx.Rollback()
+
+	access, refresh, err := insertTokenPair(ctx, tx, userID, 0, accessTTL, refreshTTL, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, nil
+}
+
+// Rotate exchanges a refresh token for a new authentication token and refresh token in the
+// same family. The old refresh token is marked as used rather than deleted, so that we can
+// tell if it's presented again. If it is, somebody else has a copy of it and we can't know
+// which client is the real one, so the whole family is deleted and ErrTokenReused returned
+// along with the reused token, which tells the caller whose session was revoked. As with
+// NewSession, a zero accessTTL skips the authentication token. ErrRecordNotFound is returned
+// for unknown or expired refresh tokens
+func (m TokenModel) Rotate(refreshPlaintext string, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	tokenHash := sha256.Sum256([]byte(refreshPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer tx.Rollback()
+
+	// lock the row, so that two requests racing with the same refresh token can't both rotate it
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)`
+		SELECT user_id, family, expiry, used_at
+		FROM tokens
+		WHERE hash = $1 AND scope = $2
+		FOR UPDATE`
+
+	var (
+		userID int64
+		family int64
+		expiry time.Time
+		usedAt sql.NullTime
+	)
+
+	err = tx.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh).Scan(&userID, &family, &expiry, &usedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if usedAt.Valid {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, family)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		reused := &Token{Plaintext: refreshPlaintext, UserID: userID, Family: family, Scope: ScopeRefresh, Expiry: expiry}
+
+		return nil, reused, ErrTokenReused
+	}
+
+	if expiry.Before(time.Now()) {
+		return nil, nil, ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = NOW() WHERE hash = $1`, tokenHash[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the family's old authentication token is replaced by the new one
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1 AND scope = $2`, family, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access, refresh, err := insertTokenPair(ctx, tx, userID, family, accessTTL, refreshTTL, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, nil
+}
+
+// insertTokenPair generates an authentication token and a refresh token and inserts them inside
+// the given transaction. A family of zero starts a new one, and a zero accessTTL skips the
+// authentication token
+func insertTokenPair(ctx context.Context, tx *sql.Tx, userID, family int64, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	var access *Token
+	var err error
+
+	tokens := []*Token{}
+
+	if accessTTL > 0 {
+		access, err = generateToken(userID, accessTTL, ScopeAuthentication)
+		if err != nil {
+			return nil, nil, err
+		}
 
+		tokens = append(tokens, access)
+	}
+
+	refresh, err := generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tokens = append(tokens, refresh)
+
+	for _, token := range tokens {
+		token.UserAgent = userAgent
+		token.IP = ip
+		token.Family = family
+
+		err = insertToken(ctx, tx, token)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// the refresh token joins the family the authentication token started
+		family = token.Family
+	}
+
+	return access, refresh, nil
+}
+
+// Insert creates new record in tokens table
+func (m TokenModel) Insert(token *Token) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	return insertToken(ctx, m.DB, token)
+}
+
+// insertToken inserts a token using either the connection pool or a transaction. Tokens
+// without a family are given a new one
+func insertToken(ctx context.Context, db interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}, token *Token) error {
+	// define query
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip, family)
+		VALUES ($1, $2, $3, $4, $5, $6, COALESCE(NULLIF($7, 0), nextval('tokens_family_seq')))
+		RETURNING family`
+
 	args := []any{
 		token.Hash,
 		token.UserID,
 		token.Expiry,
 		token.Scope,
+		token.UserAgent,
+		token.IP,
+		token.Family,
 	}
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
-	return err
+	return db.QueryRowContext(ctx, query, args...).Scan(&token.Family)
 }
 
 // DeleteAllForUser deletes all known tokens for a specific user and scope
@@ -132,3 +403,219 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// GetFamily returns the family of the token with the given scope and plaintext, returning
+// ErrRecordNotFound if there's no such token
+func (m TokenModel) GetFamily(scope string, tokenPlaintext string) (int64, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT family
+		FROM tokens
+		WHERE scope = $1 AND hash = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var family int64
+
+	err := m.DB.QueryRowContext(ctx, query, scope, tokenHash[:]).Scan(&family)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return family, nil
+}
+
+// DeleteAllForUserExcept deletes all the tokens for a specific user and scope, apart from
+// those in the given family. We use it to log a user out everywhere but the session they're
+// currently using
+func (m TokenModel) DeleteAllForUserExcept(scope string, userID int64, family int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND family <> $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, userID, family)
+	return err
+}
+
+// DeleteFamily deletes the token with the given scope and plaintext, along with every other
+// token in its family, returning ErrRecordNotFound if there's no such token. Logging out with
+// an authentication token this way revokes the refresh token which came with it too
+func (m TokenModel) DeleteFamily(scope string, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE family = (SELECT family FROM tokens WHERE scope = $1 AND hash = $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, scope, tokenHash[:])
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// RecordFailedAttempt counts a failed attempt to use the token with the given scope and
+// plaintext, like a wrong code sent with a two-factor pending token, and deletes the token
+// once it has had maxAttempts of them
+func (m TokenModel) RecordFailedAttempt(scope string, tokenPlaintext string, maxAttempts int) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		WITH token AS (
+			UPDATE tokens
+			SET attempts = attempts + 1
+			WHERE scope = $1 AND hash = $2
+			RETURNING hash, attempts
+		)
+		DELETE FROM tokens
+		WHERE hash IN (SELECT hash FROM token WHERE attempts >= $3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, tokenHash[:], maxAttempts)
+	return err
+}
+
+// DeleteExpired deletes every expired token. Tokens are never accepted after they expire, so
+// this just stops the tokens table growing forever
+func (m TokenModel) DeleteExpired() error {
+	query := `
+		DELETE FROM tokens
+		WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
+
+// Touch records that an authentication token has just been used, and by which client. To keep
+// writes down, nothing happens if the token has already been used in the last sessionTouchInterval
+func (m TokenModel) Touch(tokenPlaintext string, userAgent, ip string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		UPDATE tokens
+		SET last_used_at = NOW(), user_agent = $2, ip = $3
+		WHERE hash = $1 AND last_used_at < $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], userAgent, ip, time.Now().Add(-sessionTouchInterval))
+	return err
+}
+
+// GetSessionsForUser returns the user's sessions which haven't expired, most recently used
+// first. The session with the family current is marked as the current one
+func (m TokenModel) GetSessionsForUser(userID int64, current int64) ([]*Session, error) {
+	// used refresh tokens are kept until they expire to detect reuse, and still tell us when
+	// the session started, but only unused tokens keep a session alive. The user agent and IP
+	// come from whichever token was used most recently
+	query := `
+		SELECT family, min(created_at), max(last_used_at),
+			max(expiry) FILTER (WHERE used_at IS NULL),
+			(array_agg(user_agent ORDER BY last_used_at DESC, id DESC))[1],
+			(array_agg(ip ORDER BY last_used_at DESC, id DESC))[1],
+			family = $2
+		FROM tokens
+		WHERE user_id = $1 AND scope = ANY($3)
+		GROUP BY family
+		HAVING bool_or(used_at IS NULL AND expiry > $4)
+		ORDER BY max(last_used_at) DESC, family DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	scopes := []string{ScopeAuthentication, ScopeRefresh}
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, current, pq.Array(scopes), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.IP,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteSession deletes all the tokens in one of the user's sessions, returning
+// ErrRecordNotFound if the user has no such session
+func (m TokenModel) DeleteSession(userID int64, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM tokens
+		WHERE family = $1 AND user_id = $2 AND scope = ANY($3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	scopes := []string{ScopeAuthentication, ScopeRefresh}
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID, pq.Array(scopes))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
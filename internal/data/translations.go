@@ -0,0 +1,224 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lib/pq"
+	"greenlight.twd.net/internal/validator"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LocaleRX is a regular expression for sanity checking BCP 47 style language tags
+// like "fr", "pt-br" or "zh-hant-tw". We store and compare locales in lower case.
+var (
+	LocaleRX = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+)
+
+// MovieTranslationModel defines struct type which wraps a sql.DB connection pool
+type MovieTranslationModel struct {
+	DB *sql.DB
+}
+
+// MovieTranslation holds the localized title and synopsis of a movie for one locale
+type MovieTranslation struct {
+	MovieID  int64  `json:"movie_id"`
+	Locale   string `json:"locale"`
+	Title    string `json:"title"`
+	Synopsis string `json:"synopsis,omitempty"`
+	Version  int32  `json:"version"`
+}
+
+// NormalizeLocale converts a language tag into the lower case form we store,
+// so that "pt-BR", "pt_br" and "PT-br" are all treated as the same locale
+func NormalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// ValidateLocale checks that a (normalized) locale looks like a language tag
+func ValidateLocale(v *validator.Validator, locale string) {
+	v.Check(locale != "", "locale", "must be provided")
+	v.Check(v.Matches(locale, LocaleRX), "locale", "must be a valid language tag, like fr or pt-br")
+}
+
+// ValidateTranslation runs our validation checks on a translation
+func ValidateTranslation(v *validator.Validator, translation *MovieTranslation) {
+	ValidateLocale(v, translation.Locale)
+
+	v.Check(translation.Title != "", "title", "title must not be empty")
+	v.Check(len(translation.Title) <= 500, "title", "title must be less then 500 bytes long")
+
+	v.Check(len(translation.Synopsis) <= 10_000, "synopsis", "synopsis must be less then 10000 bytes long")
+}
+
+// GetAllForMovie retrieves every translation of a movie, ordered by locale
+func (m MovieTranslationModel) GetAllForMovie(movieID int64) ([]*MovieTranslation, error) {
+	query := `
+		SELECT movie_id, locale, title, synopsis, version
+		FROM movie_translations
+		WHERE movie_id = $1
+		ORDER BY locale ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	translations := []*MovieTranslation{}
+
+	for rows.Next() {
+		var translation MovieTranslation
+
+		err := rows.Scan(
+			&translation.MovieID,
+			&translation.Locale,
+			&translation.Title,
+			&translation.Synopsis,
+			&translation.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		translations = append(translations, &translation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return translations, nil
+}
+
+// Upsert inserts the translation, or replaces the existing translation of the movie
+// for the same locale. Each replacement bumps the version.
+func (m MovieTranslationModel) Upsert(translation *MovieTranslation) error {
+	query := `
+		INSERT INTO movie_translations (movie_id, locale, title, synopsis)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (movie_id, locale) DO UPDATE
+		SET title = EXCLUDED.title, synopsis = EXCLUDED.synopsis, version = movie_translations.version + 1
+		RETURNING version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []any{translation.MovieID, translation.Locale, translation.Title, translation.Synopsis}
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&translation.Version)
+}
+
+// Delete removes the translation of a movie for the given locale
+func (m MovieTranslationModel) Delete(movieID int64, locale string) error {
+	query := `
+		DELETE FROM movie_translations
+		WHERE movie_id = $1 AND locale = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, movieID, locale)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Localize replaces the title and synopsis of each movie with the best matching
+// translation for the client's preferred locales, which should be in order of
+// preference. A locale like "pt-br" also matches a plain "pt" translation, but at a
+// lower priority than an exact match. Movies without a suitable translation are
+// left untouched, so clients always fall back to the original title.
+func (m MovieTranslationModel) Localize(movies []*Movie, locales []string) error {
+	if len(movies) == 0 || len(locales) == 0 {
+		return nil
+	}
+
+	// Build the list of candidate locales in priority order, adding the base language
+	// after each regional locale. The rank map records each candidate's position.
+	rank := make(map[string]int)
+	candidates := []string{}
+
+	for _, locale := range locales {
+		for _, candidate := range []string{locale, strings.SplitN(locale, "-", 2)[0]} {
+			if _, exists := rank[candidate]; !exists {
+				rank[candidate] = len(candidates)
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+
+	ids := make([]int64, len(movies))
+	for i, movie := range movies {
+		ids[i] = movie.ID
+	}
+
+	query := `
+		SELECT movie_id, locale, title, synopsis
+		FROM movie_translations
+		WHERE movie_id = ANY($1) AND locale = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids), pq.Array(candidates))
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	// keep the best ranked translation we've seen for each movie
+	best := make(map[int64]MovieTranslation)
+
+	for rows.Next() {
+		var translation MovieTranslation
+
+		err := rows.Scan(&translation.MovieID, &translation.Locale, &translation.Title, &translation.Synopsis)
+		if err != nil {
+			return err
+		}
+
+		current, found := best[translation.MovieID]
+		if !found || rank[translation.Locale] < rank[current.Locale] {
+			best[translation.MovieID] = translation
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, movie := range movies {
+		translation, found := best[movie.ID]
+		if !found {
+			continue
+		}
+
+		movie.OriginalTitle = movie.Title
+		movie.Title = translation.Title
+		movie.Locale = translation.Locale
+
+		// only replace the synopsis if the translation actually has one
+		if translation.Synopsis != "" {
+			movie.Synopsis = translation.Synopsis
+		}
+	}
+
+	return nil
+}
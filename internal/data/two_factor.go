@@ -0,0 +1,284 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"greenlight.twd.net/internal/validator"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TOTPCodeRX matches the six digit codes shown by authenticator apps
+var (
+	TOTPCodeRX = regexp.MustCompile(`^[0-9]{6}$`)
+)
+
+// RecoveryCodeCount is how many recovery codes a user is given at a time
+const RecoveryCodeCount = 10
+
+// TwoFactorModel defines struct type which wraps a sql.DB connection pool
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+// TwoFactor holds a user's TOTP secret. It isn't used for logging in until the user has
+// confirmed it by sending a valid code. LastStep is the time step of the last code which
+// was accepted, so that a code can't be replayed within its validity window
+type TwoFactor struct {
+	UserID    int64
+	CreatedAt time.Time
+	Secret    string
+	Confirmed bool
+	LastStep  int64
+}
+
+// ValidateTOTPCode checks that a TOTP code has been provided and looks like one
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(v.Matches(code, TOTPCodeRX), "code", "must be 6 digits")
+}
+
+// Get retrieves the user's TOTP settings, returning ErrRecordNotFound if they haven't
+// started enrolling
+func (m TwoFactorModel) Get(userID int64) (*TwoFactor, error) {
+	query := `
+		SELECT user_id, created_at, secret, confirmed, last_step
+		FROM user_totp
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tf TwoFactor
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&tf.UserID, &tf.CreatedAt, &tf.Secret, &tf.Confirmed, &tf.LastStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &tf, nil
+}
+
+// IsEnabled reports whether the user has confirmed their TOTP secret, which means they
+// have to give a code whenever they log in
+func (m TwoFactorModel) IsEnabled(userID int64) (bool, error) {
+	tf, err := m.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return tf.Confirmed, nil
+}
+
+// SetPending stores a new unconfirmed secret for the user, replacing any earlier secret
+// which they didn't confirm. ErrEditConflict is returned if 2FA is already enabled
+func (m TwoFactorModel) SetPending(userID int64, secret string) error {
+	query := `
+		INSERT INTO user_totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, created_at = NOW(), last_step = 0
+		WHERE user_totp.confirmed = false`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// Confirm enables 2FA for the user, recording the step of the code they confirmed it with
+func (m TwoFactorModel) Confirm(userID int64, step int64) error {
+	query := `
+		UPDATE user_totp
+		SET confirmed = true, last_step = $2
+		WHERE user_id = $1 AND confirmed = false`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// UseStep records that a code from the given step has been used. It returns false if a
+// code from that step or a later one has already been used, in which case the code must
+// be rejected
+func (m TwoFactorModel) UseStep(userID int64, step int64) (bool, error) {
+	query := `
+		UPDATE user_totp
+		SET last_step = $2
+		WHERE user_id = $1 AND last_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// Delete turns 2FA off for the user, removing their secret and recovery codes
+func (m TwoFactorModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// hashRecoveryCode normalizes a recovery code before hashing it, so that users can type
+// it in either case, with or without the dash in the middle. Like tokens, the codes are
+// random enough that a plain SHA-256 hash is all we need
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// NewRecoveryCodes generates a fresh set of recovery codes for the user, replacing any
+// they had before. The plaintext codes are returned so they can be shown to the user
+// once; only their hashes are stored
+func (m TwoFactorModel) NewRecoveryCodes(userID int64) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 8)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		// 8 bytes encode to 13 base32 characters, and we keep 10 of them, like "abcde-fghij"
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range codes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hashRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+// UseRecoveryCode marks one of the user's recovery codes as used. It returns false if the
+// code doesn't belong to the user or has already been used
+func (m TwoFactorModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+		UPDATE recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND hash = $2 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// RemainingRecoveryCodes returns how many unused recovery codes the user has left
+func (m TwoFactorModel) RemainingRecoveryCodes(userID int64) (int, error) {
+	query := `
+		SELECT count(*)
+		FROM recovery_codes
+		WHERE user_id = $1 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
@@ -5,7 +5,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
-	"golang.org/x/crypto/bcrypt"
+	"fmt"
 	"greenlight.twd.net/internal/validator"
 	"time"
 )
@@ -26,15 +26,19 @@ type UserModel struct {
 // User struct used to represent an individual user. Importantly, notice how we are
 // using the json:"-" struct tag to prevent the password and version fields appearing
 // in any output when we encode it to JSON. Also notice that the Password field uses
-// the custom password type.
+// the custom password type. PendingEmail holds the new email address a user has asked
+// to change to, until they confirm it with the token we send to that address. Disabled
+// accounts have been deactivated by an administrator, and can't log in.
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID           int64     `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	Name         string    `json:"name"`
+	Email        string    `json:"email"`
+	PendingEmail string    `json:"pending_email,omitempty"`
+	Password     password  `json:"-"`
+	Activated    bool      `json:"activated"`
+	Disabled     bool      `json:"disabled"`
+	Version      int       `json:"-"`
 }
 
 // IsAnonymous check if a user instance is the Anonymous user type
@@ -53,10 +57,10 @@ type password struct {
 	hash      []byte
 }
 
-// Set method calculates the bcrypt hash of a plaintext password, and stores both
-// the has and plaintext versions in the struct.
+// Set method hashes a plaintext password with the DefaultPasswordHasher, and stores both
+// the hash and plaintext versions in the struct.
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := DefaultPasswordHasher.Hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -68,20 +72,22 @@ func (p *password) Set(plaintextPassword string) error {
 }
 
 // Matches method checks whether the provided plaintext password matches the hashed password
-// stored in the struct, returning true if it does, and false if not.
+// stored in the struct, returning true if it does, and false if not. Hashes made by any of
+// the algorithms we've used can be checked, not just the current one
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+	hasher, err := passwordHasherFor(p.hash)
 	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
+		return false, err
 	}
 
-	// otherwise return true, nil
-	return true, nil
+	return hasher.Verify(p.hash, plaintextPassword)
+}
+
+// NeedsRehash reports whether the password hash was made by an old algorithm, or with
+// outdated parameters. If it was, the password should be set again the next time we have
+// the plaintext, which is when the user logs in
+func (p *password) NeedsRehash() bool {
+	return !DefaultPasswordHasher.Recognizes(p.hash) || DefaultPasswordHasher.NeedsRehash(p.hash)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -92,7 +98,7 @@ func ValidateEmail(v *validator.Validator, email string) {
 func ValidatePassword(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "password must not be empty")
 	v.Check(len(password) >= 8, "password", "password must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "password must not be more then 72 bytes long")
+	v.Check(len(password) <= 256, "password", "password must not be more then 256 bytes long")
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -103,9 +109,10 @@ func ValidateUser(v *validator.Validator, user *User) {
 	ValidateEmail(v, user.Email)
 
 	// If the plaintext password is not nil, call the standalone
-	// ValidatePassword helper
+	// ValidatePassword helper, and check the new password against our password policy
 	if user.Password.plaintext != nil {
 		ValidatePassword(v, *user.Password.plaintext)
+		DefaultPasswordPolicy.Validate(v, *user.Password.plaintext, user)
 	}
 
 	// If the provided has is ever nil, this will be due to a logic error
@@ -159,7 +166,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 	// define the query
 	query := `
-		SELECT id, created_at, name, email, password_hash, activated, version
+		SELECT id, created_at, name, email, COALESCE(pending_email, ''), password_hash, activated, disabled, version
 		FROM users
 		WHERE email = $1`
 
@@ -174,8 +181,10 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Disabled,
 		&user.Version,
 	)
 
@@ -200,15 +209,18 @@ func (m UserModel) Update(user *User) error {
 	// define the query
 	query := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		SET name = $1, email = $2, pending_email = NULLIF($3, ''), password_hash = $4, activated = $5, disabled = $6,
+			version = version + 1
+		WHERE id = $7 AND version = $8
 		RETURNING version`
 
 	args := []any{
 		user.Name,
 		user.Email,
+		user.PendingEmail,
 		user.Password.hash,
 		user.Activated,
+		user.Disabled,
 		user.ID,
 		user.Version,
 	}
@@ -220,7 +232,7 @@ func (m UserModel) Update(user *User) error {
 
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violations unique constraint "users_email_key"`:
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
 			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
@@ -240,7 +252,8 @@ func (m UserModel) GetForToken(tokenScope string, tokenPlaintext string) (*User,
 
 	// define the query
 	query := `
-		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		SELECT users.id, users.created_at, users.name, users.email, COALESCE(users.pending_email, ''),
+			users.password_hash, users.activated, users.disabled, users.version
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
@@ -264,8 +277,10 @@ func (m UserModel) GetForToken(tokenScope string, tokenPlaintext string) (*User,
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Disabled,
 		&user.Version)
 
 	if err != nil {
@@ -279,3 +294,128 @@ func (m UserModel) GetForToken(tokenScope string, tokenPlaintext string) (*User,
 
 	return &user, nil
 }
+
+// Get retrieves a user by their ID
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, email, COALESCE(pending_email, ''), password_hash, activated, disabled, version
+		FROM users
+		WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.PendingEmail,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Disabled,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// GetAll retrieves a paginated list of users. The search string is matched case-insensitively
+// against any part of the name or email address, and an empty string matches everyone
+func (m UserModel) GetAll(search string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, email, COALESCE(pending_email, ''), password_hash,
+			activated, disabled, version
+		FROM users
+		WHERE (name ILIKE '%%' || $1 || '%%' OR email ILIKE '%%' || $1 || '%%' OR $1 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, search, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.PendingEmail,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Disabled,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
+// Delete removes a user by their ID. Their tokens and permissions are removed along
+// with them by the ON DELETE CASCADE constraints
+func (m UserModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM users
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
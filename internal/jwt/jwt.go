@@ -0,0 +1,256 @@
+package jwt
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// This package implements just enough of JSON Web Tokens (RFC 7519) to issue and verify
+// our own access tokens. Tokens are always signed with Ed25519 (the "EdDSA" algorithm of
+// RFC 8037), and the algorithm in a token's header is never trusted to pick anything else.
+
+var (
+	// ErrInvalidToken is returned for tokens which are malformed or have a bad signature
+	ErrInvalidToken = errors.New("invalid token")
+
+	// ErrExpiredToken is returned for tokens which were valid, but have expired
+	ErrExpiredToken = errors.New("expired token")
+
+	// ErrUnknownKey is returned for tokens signed with a key which isn't in the key set,
+	// usually because it has been rotated out
+	ErrUnknownKey = errors.New("unknown signing key")
+)
+
+// encoding is the unpadded base64url encoding used for every part of a token
+var encoding = base64.RawURLEncoding
+
+// Key is an Ed25519 key pair. The ID is derived from the public key, and is put in the
+// header of every token the key signs so that verifiers know which key to use
+type Key struct {
+	ID      string
+	Private ed25519.PrivateKey
+	Public  ed25519.PublicKey
+}
+
+// NewKey returns the key pair for an Ed25519 seed
+func NewKey(seed []byte) (Key, error) {
+	if len(seed) != ed25519.SeedSize {
+		return Key{}, fmt.Errorf("key seed must be %d bytes long", ed25519.SeedSize)
+	}
+
+	private := ed25519.NewKeyFromSeed(seed)
+	public := private.Public().(ed25519.PublicKey)
+
+	sum := sha256.Sum256(public)
+
+	return Key{ID: encoding.EncodeToString(sum[:8]), Private: private, Public: public}, nil
+}
+
+// GenerateKey returns a new random key pair
+func GenerateKey() (Key, error) {
+	seed := make([]byte, ed25519.SeedSize)
+
+	_, err := rand.Read(seed)
+	if err != nil {
+		return Key{}, err
+	}
+
+	return NewKey(seed)
+}
+
+// KeySet holds the keys tokens are signed and verified with. The first key signs new
+// tokens, and the rest are only used to verify tokens which they signed before being
+// rotated out
+type KeySet struct {
+	keys []Key
+}
+
+// NewKeySet returns a key set which signs with the first of the given keys
+func NewKeySet(keys ...Key) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("key set must contain at least 1 key")
+	}
+
+	return &KeySet{keys: keys}, nil
+}
+
+// LoadKeySet reads a key set from a file containing one base64url encoded Ed25519 seed per
+// line. Blank lines and lines starting with # are ignored. To rotate keys, add a new seed as
+// the first line, and remove the old one once the tokens it signed have all expired
+func LoadKeySet(path string) (*KeySet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var keys []Key
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		seed, err := encoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		key, err := NewKey(seed)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return NewKeySet(keys...)
+}
+
+// header is the JOSE header of a token
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// expiry is the part of every token's claims which Verify checks itself
+type expiry struct {
+	Expiry int64 `json:"exp"`
+}
+
+// Sign encodes the claims as a token signed with the current key. The claims should
+// include an "exp" claim, as Verify rejects tokens without one
+func (ks *KeySet) Sign(claims any) (string, error) {
+	key := ks.keys[0]
+
+	headerJSON, err := json.Marshal(header{Algorithm: "EdDSA", Type: "JWT", KeyID: key.ID})
+	if err != nil {
+		return "", err
+	}
+
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encoding.EncodeToString(headerJSON) + "." + encoding.EncodeToString(claimsJSON)
+
+	signature := ed25519.Sign(key.Private, []byte(signingInput))
+
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
+
+// Verify checks a token's signature and expiry, and decodes its claims into dst
+func (ks *KeySet) Verify(token string, dst any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	headerJSON, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	var h header
+
+	err = json.Unmarshal(headerJSON, &h)
+	if err != nil || h.Algorithm != "EdDSA" {
+		return ErrInvalidToken
+	}
+
+	key, ok := ks.find(h.KeyID)
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if !ed25519.Verify(key.Public, []byte(parts[0]+"."+parts[1]), signature) {
+		return ErrInvalidToken
+	}
+
+	claimsJSON, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	var exp expiry
+
+	err = json.Unmarshal(claimsJSON, &exp)
+	if err != nil || exp.Expiry == 0 {
+		return ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= exp.Expiry {
+		return ErrExpiredToken
+	}
+
+	err = json.Unmarshal(claimsJSON, dst)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+// find returns the key with the given ID
+func (ks *KeySet) find(id string) (Key, bool) {
+	for _, key := range ks.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+
+	return Key{}, false
+}
+
+// JWK is the JSON Web Key (RFC 7517) form of a public key
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// JWKS returns the public keys in the set, so that other services can verify our tokens
+// without asking us. The current signing key comes first
+func (ks *KeySet) JWKS() []JWK {
+	jwks := make([]JWK, 0, len(ks.keys))
+
+	for _, key := range ks.keys {
+		jwks = append(jwks, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         encoding.EncodeToString(key.Public),
+			KeyID:     key.ID,
+			Use:       "sig",
+			Algorithm: "EdDSA",
+		})
+	}
+
+	return jwks
+}
@@ -0,0 +1,470 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This package is a relying party for OpenID Connect logins with the authorization code flow
+// and PKCE. It only implements what that needs: discovery, building the authorization URL,
+// exchanging the code, and verifying ID tokens signed with RS256 or ES256 against the issuer's
+// published keys.
+
+var (
+	// ErrInvalidIDToken is returned for ID tokens which are malformed, have a bad signature,
+	// or whose claims don't check out
+	ErrInvalidIDToken = errors.New("invalid ID token")
+
+	// ErrUnknownKey is returned for ID tokens signed with a key the issuer doesn't publish
+	ErrUnknownKey = errors.New("unknown signing key")
+)
+
+// encoding is the unpadded base64url encoding used by JWTs, JWKs and PKCE
+var encoding = base64.RawURLEncoding
+
+// keysRefreshInterval is how often we're willing to fetch the issuer's keys again when an ID
+// token is signed with a key we don't have, which happens after the issuer rotates its keys
+const keysRefreshInterval = time.Minute
+
+// clockSkew is how far the issuer's clock is allowed to be ahead of ours
+const clockSkew = time.Minute
+
+// Config identifies us to the issuer. The redirect URL must be registered with the issuer
+type Config struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Provider is an OpenID Connect issuer, as described by its discovery document
+type Provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	client *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// Claims are the ID token claims we use. Audience can be a string or a list in the token, so
+// it's decoded separately
+type Claims struct {
+	Issuer        string `json:"iss"`
+	Subject       string `json:"sub"`
+	Expiry        int64  `json:"exp"`
+	IssuedAt      int64  `json:"iat"`
+	Nonce         string `json:"nonce"`
+	AuthorizedBy  string `json:"azp"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Audience      []string
+}
+
+// Discover fetches the issuer's discovery document. The issuer in the document must match
+// the one we asked for exactly, as the spec requires
+func Discover(ctx context.Context, issuer string, client *http.Client) (*Provider, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	provider := &Provider{client: client}
+
+	err := getJSON(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", provider)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	if provider.Issuer != issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q doesn't match %q", provider.Issuer, issuer)
+	}
+
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: document is missing endpoints")
+	}
+
+	return provider, nil
+}
+
+// RandomString returns a random string for use as a state, nonce or PKCE code verifier
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+// CodeChallenge returns the S256 PKCE code challenge for a code verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return encoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL to send the user to, to log in with the issuer
+func (p *Provider) AuthCodeURL(cfg Config, state, nonce, verifier string) string {
+	scopes := cfg.Scopes
+	if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {cfg.ClientID},
+		"redirect_uri":          {cfg.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {CodeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return p.AuthorizationEndpoint + separator + params.Encode()
+}
+
+// Exchange swaps an authorization code for the issuer's tokens, returning the raw ID token
+func (p *Provider) Exchange(ctx context.Context, cfg Config, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc token exchange: %s: %s", resp.Status, body)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+
+	err = json.Unmarshal(body, &tokens)
+	if err != nil {
+		return "", fmt.Errorf("oidc token exchange: %w", err)
+	}
+
+	if tokens.IDToken == "" {
+		return "", errors.New("oidc token exchange: no id_token in response")
+	}
+
+	return tokens.IDToken, nil
+}
+
+// VerifyIDToken checks an ID token's signature against the issuer's keys, and that it was
+// issued by the issuer, for us, hasn't expired, and carries the nonce we sent
+func (p *Provider) VerifyIDToken(ctx context.Context, cfg Config, raw, nonce string) (*Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+
+	headerJSON, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	key, err := p.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifySignature(header.Algorithm, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+
+	claimsJSON, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	var claims Claims
+
+	err = json.Unmarshal(claimsJSON, &claims)
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	claims.Audience, err = audience(claimsJSON)
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	now := time.Now()
+
+	switch {
+	case claims.Issuer != p.Issuer:
+		return nil, fmt.Errorf("%w: wrong issuer", ErrInvalidIDToken)
+	case !slices.Contains(claims.Audience, cfg.ClientID):
+		return nil, fmt.Errorf("%w: wrong audience", ErrInvalidIDToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != cfg.ClientID:
+		return nil, fmt.Errorf("%w: wrong authorized party", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	case claims.Expiry == 0 || !now.Before(time.Unix(claims.Expiry, 0)):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(clockSkew)):
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidIDToken)
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: wrong nonce", ErrInvalidIDToken)
+	}
+
+	return &claims, nil
+}
+
+// audience decodes the aud claim, which is either a single string or a list of them
+func audience(claimsJSON []byte) ([]string, error) {
+	var raw struct {
+		Audience json.RawMessage `json:"aud"`
+	}
+
+	err := json.Unmarshal(claimsJSON, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var single string
+	if json.Unmarshal(raw.Audience, &single) == nil {
+		return []string{single}, nil
+	}
+
+	var list []string
+	err = json.Unmarshal(raw.Audience, &list)
+	return list, err
+}
+
+// verifySignature checks a JWS signature made with one of the algorithms we support
+func verifySignature(algorithm string, key crypto.PublicKey, signingInput, signature []byte) error {
+	digest := sha256.Sum256(signingInput)
+
+	switch algorithm {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) != nil {
+			return ErrInvalidIDToken
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return ErrInvalidIDToken
+		}
+
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return ErrInvalidIDToken
+		}
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidIDToken, algorithm)
+	}
+
+	return nil
+}
+
+// key returns the issuer's public key with the given ID, fetching the issuer's keys if we
+// don't have them yet, or if it's a key we haven't seen and we haven't fetched them lately
+func (p *Provider) key(ctx context.Context, id string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[id]; ok {
+		return key, nil
+	}
+
+	if p.keys != nil && time.Since(p.keysFetched) < keysRefreshInterval {
+		return nil, ErrUnknownKey
+	}
+
+	keys, err := p.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	if key, ok := p.keys[id]; ok {
+		return key, nil
+	}
+
+	return nil, ErrUnknownKey
+}
+
+// jwk is a JSON Web Key, with the fields for RSA and EC keys
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// fetchKeys fetches the issuer's signing keys from its JWKS document. Keys of a type we
+// don't support are skipped
+func (p *Provider) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	err := getJSON(ctx, p.client, p.JWKSURI, &set)
+	if err != nil {
+		return nil, fmt.Errorf("oidc keys: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+
+		keys[k.KeyID] = key
+	}
+
+	return keys, nil
+}
+
+// publicKey decodes the key
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := encoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := encoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, errors.New("unsupported curve")
+		}
+
+		x, err := encoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := encoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on curve")
+		}
+
+		return key, nil
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+}
+
+// getJSON fetches a URL and decodes the JSON response into dst
+func getJSON(ctx context.Context, client *http.Client, url string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(dst)
+}
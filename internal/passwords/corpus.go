@@ -0,0 +1,100 @@
+package passwords
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// PrefixLength is the number of hex characters of a SHA-1 hash used to pick the range it
+// belongs to, the same as the Pwned Passwords range API
+const PrefixLength = 5
+
+// Corpus holds the SHA-1 hashes of passwords which are known to have been breached. The
+// hashes are split into ranges by their first five hex characters, which is how the
+// k-anonymity range API works, but everything is held in memory so no password (or part
+// of its hash) ever leaves the server.
+type Corpus struct {
+	ranges map[string][]string
+	size   int
+}
+
+// LoadCorpus reads a corpus from a file, like the ones which can be downloaded from Pwned
+// Passwords. Each line holds an upper or lower case SHA-1 hash in hex, optionally followed by
+// a colon and the number of times it's been seen, which we ignore. Blank lines and lines
+// starting with # are skipped.
+func LoadCorpus(path string) (*Corpus, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadCorpus(file)
+}
+
+// ReadCorpus reads a corpus in the format described by LoadCorpus from r
+func ReadCorpus(r io.Reader) (*Corpus, error) {
+	corpus := &Corpus{ranges: make(map[string][]string)}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+
+		if len(hash) != 2*sha1.Size {
+			return nil, fmt.Errorf("line %d: expected a %d character SHA-1 hash", line, 2*sha1.Size)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		prefix, suffix := hash[:PrefixLength], hash[PrefixLength:]
+		corpus.ranges[prefix] = append(corpus.ranges[prefix], suffix)
+		corpus.size++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// sort each range so that lookups can use a binary search
+	for _, suffixes := range corpus.ranges {
+		slices.Sort(suffixes)
+	}
+
+	return corpus, nil
+}
+
+// Len returns the number of hashes in the corpus
+func (c *Corpus) Len() int {
+	return c.size
+}
+
+// Contains reports whether the password is in the corpus. A nil corpus contains nothing,
+// so callers don't need to check whether one was loaded
+func (c *Corpus) Contains(password string) bool {
+	if c == nil {
+		return false
+	}
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	_, found := slices.BinarySearch(c.ranges[hash[:PrefixLength]], hash[PrefixLength:])
+	return found
+}
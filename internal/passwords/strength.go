@@ -0,0 +1,233 @@
+package passwords
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Score estimates how hard a password is to guess, from 0 (trivially guessable) to 4 (very
+// hard), on the same scale as zxcvbn. Like zxcvbn it looks for the patterns people use to
+// build passwords, such as common words, keyboard rows, sequences, repeats and years, and
+// works out the fewest guesses an attacker who knows about those patterns would need.
+// Anything which isn't part of a pattern is counted as brute force. userInputs are words
+// which are easy to guess for this particular user, like their name, and count as the
+// most common words of all.
+func Score(password string, userInputs ...string) int {
+	guesses := Guesses(password, userInputs...)
+
+	switch {
+	case guesses < 1e3:
+		return 0
+	case guesses < 1e6:
+		return 1
+	case guesses < 1e8:
+		return 2
+	case guesses < 1e10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// bruteforceCardinality is the number of guesses each character outside of a pattern
+// adds. It's the same as zxcvbn's, and is lower than the size of the alphabet because
+// attackers try likely characters first
+const bruteforceCardinality = 10
+
+// minPatternLength is the shortest run of characters which counts as a pattern
+const minPatternLength = 3
+
+// Guesses estimates the number of guesses needed to find the password. The password is
+// split into the sequence of patterns and brute forced characters which needs the fewest
+// guesses, which we find with dynamic programming over the prefixes of the password
+func Guesses(password string, userInputs ...string) float64 {
+	runes := []rune(password)
+	n := len(runes)
+
+	dictionary := make(map[string]int, len(commonWords)+len(userInputs))
+	for i, word := range commonWords {
+		dictionary[word] = i + 1
+	}
+	for _, input := range userInputs {
+		input = strings.ToLower(input)
+		if len([]rune(input)) >= minPatternLength {
+			dictionary[input] = 1
+		}
+	}
+
+	// best[j] is the fewest guesses needed for the first j characters
+	best := make([]float64, n+1)
+	best[0] = 1
+
+	for j := 1; j <= n; j++ {
+		best[j] = best[j-1] * bruteforceCardinality
+
+		for i := j - minPatternLength; i >= 0; i-- {
+			if g := patternGuesses(runes[i:j], dictionary); g > 0 {
+				best[j] = math.Min(best[j], best[i]*g)
+			}
+		}
+	}
+
+	return best[n]
+}
+
+// patternGuesses returns the number of guesses needed for a run of characters if it
+// matches one of our patterns, or zero if it doesn't
+func patternGuesses(token []rune, dictionary map[string]int) float64 {
+	var guesses float64
+
+	consider := func(g float64) {
+		if guesses == 0 || g < guesses {
+			guesses = g
+		}
+	}
+
+	if g := dictionaryGuesses(token, dictionary); g > 0 {
+		consider(g)
+	}
+	if g := repeatGuesses(token); g > 0 {
+		consider(g)
+	}
+	if g := sequenceGuesses(token); g > 0 {
+		consider(g)
+	}
+	if g := keyboardGuesses(token); g > 0 {
+		consider(g)
+	}
+	if g := yearGuesses(token); g > 0 {
+		consider(g)
+	}
+
+	return guesses
+}
+
+// leetSubstitutions undoes the common swaps of letters for digits and symbols
+var leetSubstitutions = strings.NewReplacer(
+	"4", "a", "@", "a", "3", "e", "1", "i", "!", "i", "0", "o", "$", "s", "5", "s", "7", "t",
+)
+
+// dictionaryGuesses matches common words, allowing for capital letters and leet speak. The
+// guesses are the word's rank in the dictionary, doubled for each kind of variation
+func dictionaryGuesses(token []rune, dictionary map[string]int) float64 {
+	word := string(token)
+	lower := strings.ToLower(word)
+
+	multiplier := 1.0
+	if lower != word {
+		multiplier *= 2
+	}
+
+	rank, ok := dictionary[lower]
+	if !ok {
+		unleeted := leetSubstitutions.Replace(lower)
+		if unleeted == lower {
+			return 0
+		}
+
+		rank, ok = dictionary[unleeted]
+		if !ok {
+			return 0
+		}
+		multiplier *= 2
+	}
+
+	return float64(rank) * multiplier
+}
+
+// repeatGuesses matches a single character repeated, like "aaaa"
+func repeatGuesses(token []rune) float64 {
+	for _, r := range token[1:] {
+		if r != token[0] {
+			return 0
+		}
+	}
+
+	return float64(characterCardinality(token[0]) * len(token))
+}
+
+// sequenceGuesses matches characters which go up or down one at a time, like "abcd" or "4321"
+func sequenceGuesses(token []rune) float64 {
+	delta := token[1] - token[0]
+	if delta != 1 && delta != -1 {
+		return 0
+	}
+
+	for i := 2; i < len(token); i++ {
+		if token[i]-token[i-1] != delta {
+			return 0
+		}
+	}
+
+	// sequences starting at an obvious place are tried first
+	base := float64(characterCardinality(token[0]))
+	if strings.ContainsRune("aAzZ019", token[0]) {
+		base = 4
+	}
+
+	if delta < 0 {
+		base *= 2
+	}
+
+	return base * float64(len(token))
+}
+
+// keyboardRows are the rows of a QWERTY keyboard. Runs along them are matched in either direction
+var keyboardRows = []string{"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./"}
+
+// keyboardGuesses matches runs of keys along a keyboard row, like "qwerty"
+func keyboardGuesses(token []rune) float64 {
+	if len(token) < 4 {
+		return 0
+	}
+
+	lower := strings.ToLower(string(token))
+	reversed := []rune(lower)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+
+	for _, row := range keyboardRows {
+		if strings.Contains(row, lower) || strings.Contains(row, string(reversed)) {
+			return float64(len(keyboardRows) * len(row) * len(token))
+		}
+	}
+
+	return 0
+}
+
+// yearGuesses matches recent years, which people often add to the end of passwords
+func yearGuesses(token []rune) float64 {
+	if len(token) != 4 {
+		return 0
+	}
+
+	year := 0
+	for _, r := range token {
+		if r < '0' || r > '9' {
+			return 0
+		}
+		year = year*10 + int(r-'0')
+	}
+
+	if year < 1900 || year > 2099 {
+		return 0
+	}
+
+	return 200
+}
+
+// characterCardinality is the size of the class of characters which r belongs to
+func characterCardinality(r rune) int {
+	switch {
+	case unicode.IsLower(r):
+		return 26
+	case unicode.IsUpper(r):
+		return 26
+	case unicode.IsDigit(r):
+		return 10
+	default:
+		return 33
+	}
+}
@@ -0,0 +1,36 @@
+package passwords
+
+// commonWords are the most common passwords, and words which often appear in them, roughly
+// in order of how common they are. A word's position in the list is how many guesses it
+// takes to find. It's deliberately short: the breached password corpus is the place for
+// long lists, and this is only here so that passwords built from obvious words score badly
+var commonWords = []string{
+	"password", "123456", "qwerty", "admin", "welcome", "letmein", "monkey", "dragon",
+	"football", "baseball", "iloveyou", "master", "sunshine", "princess", "shadow", "superman",
+	"michael", "jennifer", "jordan", "hunter", "trustno1", "batman", "starwars", "computer",
+	"secret", "login", "freedom", "whatever", "passw0rd", "hello", "charlie", "donald",
+	"love", "soccer", "hockey", "killer", "george", "ashley", "thomas", "robert",
+	"daniel", "andrew", "joshua", "matthew", "summer", "winter", "spring", "autumn",
+	"flower", "orange", "banana", "apple", "cheese", "pepper", "ginger", "cookie",
+	"chocolate", "coffee", "tigger", "buster", "maggie", "bailey", "ranger", "harley",
+	"yankees", "eagles", "cowboys", "dolphins", "lakers", "chelsea", "arsenal", "liverpool",
+	"mustang", "corvette", "ferrari", "porsche", "mercedes", "camaro", "jaguar", "tiger",
+	"angel", "heaven", "jesus", "god", "blessed", "faith", "family", "forever",
+	"friends", "lovely", "happy", "smile", "sweet", "pretty", "baby", "honey",
+	"money", "rich", "power", "gold", "silver", "diamond", "magic", "wizard",
+	"ninja", "pirate", "zombie", "vampire", "matrix", "hacker", "access", "changeme",
+	"default", "guest", "user", "test", "temp", "root", "system", "server",
+	"internet", "google", "facebook", "twitter", "amazon", "microsoft", "windows", "linux",
+	"movie", "movies", "film", "cinema", "greenlight", "netflix", "hollywood", "popcorn",
+	"star", "sun", "moon", "sky", "ocean", "river", "mountain", "forest",
+	"sydney", "london", "paris", "berlin", "tokyo", "newyork", "america", "canada",
+	"january", "february", "march", "april", "may", "june", "july", "august",
+	"september", "october", "november", "december", "monday", "friday", "sunday", "weekend",
+	"red", "blue", "green", "black", "white", "purple", "yellow", "pink",
+	"one", "two", "three", "four", "five", "six", "seven", "eight",
+	"nine", "ten", "first", "last", "new", "old", "big", "little",
+	"cat", "dog", "bird", "fish", "horse", "lion", "bear", "wolf",
+	"boy", "girl", "man", "woman", "king", "queen", "prince", "lady",
+	"abc", "abcd", "xyz", "qwe", "asd", "zxc", "aaa", "pass",
+	"word", "key", "lock", "open", "sesame", "please", "thanks", "sorry",
+}
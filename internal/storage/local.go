@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Local is a Storage backend which keeps objects as files underneath a root
+// directory on the local filesystem
+type Local struct {
+	root string
+}
+
+// NewLocal returns a Local storage backend rooted at dir, creating the directory
+// if it doesn't already exist
+func NewLocal(dir string) (*Local, error) {
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Local{root: dir}, nil
+}
+
+// filename converts a storage key into a path underneath the root directory. We
+// refuse any key which would escape the root (for example one containing "..")
+func (l *Local) filename(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+
+	return filepath.Join(l.root, filepath.FromSlash(cleaned)), nil
+}
+
+// Put writes the object to a temporary file first and then renames it into place,
+// so that readers never see a partially written file
+func (l *Local) Put(key string, r io.Reader) error {
+	name, err := l.filename(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(name), 0o750)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+
+	// if anything goes wrong below, make sure we don't leave the temporary file lying around
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+// Open opens the file stored under key for reading
+func (l *Local) Open(key string) (io.ReadCloser, error) {
+	name, err := l.filename(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return nil, ErrNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// Delete removes the file stored under key
+func (l *Local) Delete(key string) error {
+	name, err := l.filename(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
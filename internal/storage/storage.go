@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned by a Storage backend when no object exists for the requested key
+var ErrNotFound = errors.New("object not found")
+
+// Storage is the interface implemented by every file storage backend. Keys are
+// slash-separated paths like "movies/12/poster/<random>/original", and it's up to
+// each backend to decide how they map onto its own layout. Keeping this interface
+// small means we can swap the local filesystem out for an object store later without
+// touching any of the handlers.
+type Storage interface {
+	// Put stores the contents of r under key, replacing any existing object
+	Put(key string, r io.Reader) error
+
+	// Open returns a reader for the object stored under key. The caller must
+	// close it when finished. If there is no such object, ErrNotFound is returned
+	Open(key string) (io.ReadCloser, error)
+
+	// Delete removes the object stored under key. Deleting a key which doesn't
+	// exist is not an error
+	Delete(key string) error
+}
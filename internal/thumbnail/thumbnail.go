@@ -0,0 +1,104 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+
+	// register the GIF and PNG decoders with the image package, so that image.Decode()
+	// can read them alongside JPEGs
+	_ "image/gif"
+	_ "image/png"
+)
+
+// Format is one of the image formats thumbnails are encoded in
+type Format struct {
+	ContentType string
+	Encode      func(w io.Writer, img image.Image) error
+}
+
+// Formats holds the formats every thumbnail is generated in, by the name clients ask for
+// them with. JPEG gives small files for photos and is understood by every client. The WebP
+// encoder in this package is lossless, so it keeps artwork with sharp edges and text crisp,
+// but is usually larger than the JPEG for photos.
+var Formats = map[string]Format{
+	"jpeg": {ContentType: "image/jpeg", Encode: EncodeJPEG},
+	"webp": {ContentType: "image/webp", Encode: EncodeWebP},
+}
+
+// Decode decodes the image held in src. Decoding is the slow part of making thumbnails, so
+// it's done once, and the result is resized for each width.
+func Decode(src []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(src))
+	return img, err
+}
+
+// Resize scales img down so that it is at most width pixels wide, preserving the aspect
+// ratio. Images which are already narrower than width are returned as they are rather than
+// being scaled up.
+func Resize(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= width {
+		return img
+	}
+
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	return resize(img, width, height)
+}
+
+// EncodeJPEG writes img to w as a JPEG
+func EncodeJPEG(w io.Writer, img image.Image) error {
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+}
+
+// resize scales src down to width x height using a box filter: every destination
+// pixel is the average of the block of source pixels which maps onto it. This is
+// slower than nearest-neighbour sampling but avoids the jagged edges and moiré you
+// otherwise get when shrinking photos by a large factor.
+func resize(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					b += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,666 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// This file holds a small encoder for lossless WebP (the "VP8L" format, described in RFC 9649).
+// Neither the standard library nor golang.org/x/image can write WebP, and binding to libwebp
+// would mean cgo and a C library on every machine which builds the API, so we do it ourselves.
+//
+// Only the parts of the format which pay for themselves on thumbnails are used: the subtract
+// green and predictor transforms, run-length backward references to the previous pixel, and
+// one set of prefix (Huffman) codes for the whole image. There's no color cache, no color
+// transform and no palette. The files come out somewhat larger than libwebp's lossless output,
+// but are still smaller than the equivalent PNG.
+
+// maxWebPDimension is the largest width or height a VP8L image can have
+const maxWebPDimension = 1 << 14
+
+// ErrWebPTooLarge is returned when an image is too wide or tall to be encoded as WebP
+var ErrWebPTooLarge = errors.New("image is too large to be encoded as WebP")
+
+const (
+	// predictorBits is the log2 of the width and height of the blocks which share a predictor
+	predictorBits = 4
+
+	// maxRunLength is the longest backward reference VP8L allows
+	maxRunLength = 4096
+
+	// minRunLength is the shortest run which is written as a backward reference rather than
+	// as literal pixels
+	minRunLength = 3
+
+	// numLengthCodes and numDistanceCodes are the number of prefix codes for backward reference
+	// lengths, which share an alphabet with green, and for distances
+	numLengthCodes   = 24
+	numDistanceCodes = 40
+
+	// previousPixelDistanceCode is the distance code which refers to the pixel immediately
+	// before the current one, which is the second entry in the format's distance map
+	previousPixelDistanceCode = 2
+
+	maxCodeLength           = 15
+	maxCodeLengthCodeLength = 7
+)
+
+// codeLengthCodeOrder is the order in which the code lengths of the code length code are written
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// EncodeWebP writes img to w as a lossless WebP image
+func EncodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width < 1 || height < 1 || width > maxWebPDimension || height > maxWebPDimension {
+		return ErrWebPTooLarge
+	}
+
+	// VP8L stores straight (not premultiplied) alpha
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+
+	pixels := make([]uint32, width*height)
+	opaque := true
+
+	for i := range pixels {
+		p := nrgba.Pix[i*4 : i*4+4]
+		pixels[i] = uint32(p[3])<<24 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+		if p[3] != 0xff {
+			opaque = false
+		}
+	}
+
+	bw := &bitWriter{}
+
+	// the header: a signature byte, the dimensions, whether there's any transparency, and a
+	// version number which is always zero
+	bw.writeBits(0x2f, 8)
+	bw.writeBits(uint32(width-1), 14)
+	bw.writeBits(uint32(height-1), 14)
+	if opaque {
+		bw.writeBits(0, 1)
+	} else {
+		bw.writeBits(1, 1)
+	}
+	bw.writeBits(0, 3)
+
+	// Transforms are listed in the order they're applied. The decoder undoes them in reverse.
+	// Subtracting green from red and blue takes out most of the correlation between channels,
+	// and the predictor then replaces each pixel with its difference from a guess based on its
+	// neighbours, which leaves mostly small values for the prefix codes to work with
+	bw.writeBits(1, 1)
+	bw.writeBits(2, 2)
+	subtractGreen(pixels)
+
+	bw.writeBits(1, 1)
+	bw.writeBits(0, 2)
+	bw.writeBits(predictorBits-2, 3)
+	modes, modesWidth := predict(pixels, width, height)
+	writeEntropyCodedImage(bw, modes, modesWidth, false)
+
+	bw.writeBits(0, 1)
+
+	writeEntropyCodedImage(bw, pixels, width, true)
+
+	payload := bw.bytes()
+
+	// wrap the bitstream in a RIFF container, padding the chunk to an even length
+	padding := len(payload) % 2
+
+	header := make([]byte, 20)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(4+8+len(payload)+padding))
+	copy(header[8:12], "WEBP")
+	copy(header[12:16], "VP8L")
+	binary.LittleEndian.PutUint32(header[16:20], uint32(len(payload)))
+
+	buf := bytes.NewBuffer(header)
+	buf.Write(payload)
+	if padding == 1 {
+		buf.WriteByte(0)
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// subtractGreen subtracts each pixel's green value from its red and blue values, in place
+func subtractGreen(pixels []uint32) {
+	for i, p := range pixels {
+		green := (p >> 8) & 0xff
+		red := ((p >> 16) - green) & 0xff
+		blue := (p - green) & 0xff
+		pixels[i] = p&0xff00ff00 | red<<16 | blue
+	}
+}
+
+// predict replaces each pixel with its difference from the prediction made by the best of the
+// format's predictor modes for its block. It returns the image of the chosen modes, one pixel
+// per block with the mode in the green channel, and that image's width
+func predict(pixels []uint32, width, height int) ([]uint32, int) {
+	blockSize := 1 << predictorBits
+	modesWidth := (width + blockSize - 1) >> predictorBits
+	modesHeight := (height + blockSize - 1) >> predictorBits
+	modes := make([]uint32, modesWidth*modesHeight)
+
+	// the predictions are made from the original neighbours, which is what the decoder will
+	// have when it reverses the transform, so the residuals go in a separate slice
+	residuals := make([]uint32, len(pixels))
+
+	for by := 0; by < modesHeight; by++ {
+		for bx := 0; bx < modesWidth; bx++ {
+			x0, y0 := bx*blockSize, by*blockSize
+			x1, y1 := min(x0+blockSize, width), min(y0+blockSize, height)
+
+			best, bestCost := 0, -1
+			for mode := 0; mode < 14; mode++ {
+				cost := 0
+				for y := y0; y < y1; y++ {
+					for x := x0; x < x1; x++ {
+						cost += residualCost(pixels[y*width+x], predictPixel(pixels, width, x, y, mode))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+
+			modes[by*modesWidth+bx] = 0xff000000 | uint32(best)<<8
+
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					residuals[y*width+x] = subtractPixels(pixels[y*width+x], predictPixel(pixels, width, x, y, best))
+				}
+			}
+		}
+	}
+
+	copy(pixels, residuals)
+
+	return modes, modesWidth
+}
+
+// residualCost estimates how expensive a pixel's residual will be to encode, as the sum of the
+// sizes of its channels' differences from the prediction
+func residualCost(pixel, prediction uint32) int {
+	residual := subtractPixels(pixel, prediction)
+
+	cost := 0
+	for shift := 0; shift < 32; shift += 8 {
+		c := int(int8(residual >> shift))
+		if c < 0 {
+			c = -c
+		}
+		cost += c
+	}
+
+	return cost
+}
+
+// predictPixel returns the prediction for the pixel at x, y with the given mode. The top row
+// and left column are always predicted from their only available neighbour, whatever the mode
+func predictPixel(pixels []uint32, width, x, y, mode int) uint32 {
+	i := y*width + x
+
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return pixels[i-1]
+	case x == 0:
+		return pixels[i-width]
+	}
+
+	left := pixels[i-1]
+	top := pixels[i-width]
+	topLeft := pixels[i-width-1]
+
+	// the pixel after the top one in memory, which for the rightmost column is the first
+	// pixel of the current row rather than the top right one
+	topRight := pixels[i-width+1]
+
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return left
+	case 2:
+		return top
+	case 3:
+		return topRight
+	case 4:
+		return topLeft
+	case 5:
+		return average(average(left, topRight), top)
+	case 6:
+		return average(left, topLeft)
+	case 7:
+		return average(left, top)
+	case 8:
+		return average(topLeft, top)
+	case 9:
+		return average(top, topRight)
+	case 10:
+		return average(average(left, topLeft), average(top, topRight))
+	case 11:
+		return selectPixel(left, top, topLeft)
+	case 12:
+		return mapChannels3(left, top, topLeft, func(l, t, tl int) int { return l + t - tl })
+	default:
+		return mapChannels3(average(left, top), topLeft, 0, func(a, tl, _ int) int { return a + (a-tl)/2 })
+	}
+}
+
+// average returns the per channel average of two pixels, rounded down
+func average(a, b uint32) uint32 {
+	return (((a ^ b) & 0xfefefefe) >> 1) + (a & b)
+}
+
+// selectPixel returns whichever of left and top is closer to the gradient estimate
+// left + top - topLeft, measured as the sum of the differences of each channel
+func selectPixel(left, top, topLeft uint32) uint32 {
+	distance := 0
+	for shift := 0; shift < 32; shift += 8 {
+		l := int(left>>shift) & 0xff
+		t := int(top>>shift) & 0xff
+		tl := int(topLeft>>shift) & 0xff
+		distance += abs(l-tl) - abs(t-tl)
+	}
+
+	if distance <= 0 {
+		return top
+	}
+
+	return left
+}
+
+// mapChannels3 applies fn to each channel of three pixels, clamping the results to 0..255
+func mapChannels3(a, b, c uint32, fn func(a, b, c int) int) uint32 {
+	var result uint32
+	for shift := 0; shift < 32; shift += 8 {
+		v := fn(int(a>>shift)&0xff, int(b>>shift)&0xff, int(c>>shift)&0xff)
+		v = max(0, min(v, 255))
+		result |= uint32(v) << shift
+	}
+
+	return result
+}
+
+// subtractPixels subtracts b from a, channel by channel, modulo 256
+func subtractPixels(a, b uint32) uint32 {
+	var result uint32
+	for shift := 0; shift < 32; shift += 8 {
+		result |= ((a>>shift - b>>shift) & 0xff) << shift
+	}
+
+	return result
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// token is either a literal pixel, or a backward reference of length copies of the previous pixel
+type token struct {
+	pixel  uint32
+	length int
+}
+
+// writeEntropyCodedImage writes pixels, which is an image width pixels wide, using prefix codes
+// built from its own statistics. The main image has one more header bit than the images which
+// hold transform data, saying that it uses one set of codes throughout
+func writeEntropyCodedImage(bw *bitWriter, pixels []uint32, width int, main bool) {
+	// find the runs of repeated pixels
+	var tokens []token
+
+	for i := 0; i < len(pixels); {
+		run := 0
+		if i > 0 {
+			for i+run < len(pixels) && run < maxRunLength && pixels[i+run] == pixels[i-1] {
+				run++
+			}
+		}
+
+		if run >= minRunLength {
+			tokens = append(tokens, token{length: run})
+			i += run
+			continue
+		}
+
+		tokens = append(tokens, token{pixel: pixels[i]})
+		i++
+	}
+
+	// Count how often each symbol is used. Green shares its alphabet with the length prefixes
+	var (
+		green    = make([]int, 256+numLengthCodes)
+		red      = make([]int, 256)
+		blue     = make([]int, 256)
+		alpha    = make([]int, 256)
+		distance = make([]int, numDistanceCodes)
+	)
+
+	distancePrefix, _, _ := prefixEncode(previousPixelDistanceCode)
+
+	for _, t := range tokens {
+		if t.length > 0 {
+			prefix, _, _ := prefixEncode(t.length)
+			green[256+prefix]++
+			distance[distancePrefix]++
+			continue
+		}
+
+		green[(t.pixel>>8)&0xff]++
+		red[(t.pixel>>16)&0xff]++
+		blue[t.pixel&0xff]++
+		alpha[t.pixel>>24]++
+	}
+
+	// no color cache
+	bw.writeBits(0, 1)
+
+	// no meta prefix codes, so the same codes are used for the whole image
+	if main {
+		bw.writeBits(0, 1)
+	}
+
+	codes := make([]prefixCode, 5)
+	for i, histogram := range [][]int{green, red, blue, alpha, distance} {
+		codes[i] = newPrefixCode(histogram, maxCodeLength)
+		writePrefixCode(bw, codes[i])
+	}
+
+	for _, t := range tokens {
+		if t.length > 0 {
+			prefix, extraBits, extra := prefixEncode(t.length)
+			codes[0].write(bw, 256+prefix)
+			bw.writeBits(extra, extraBits)
+			codes[4].write(bw, distancePrefix)
+			continue
+		}
+
+		codes[0].write(bw, int((t.pixel>>8)&0xff))
+		codes[1].write(bw, int((t.pixel>>16)&0xff))
+		codes[2].write(bw, int(t.pixel&0xff))
+		codes[3].write(bw, int(t.pixel>>24))
+	}
+}
+
+// prefixEncode splits a backward reference length or distance code into the prefix symbol
+// which is written with a prefix code, and the extra bits which follow it
+func prefixEncode(value int) (prefix int, extraBits int, extra uint32) {
+	d := value - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+
+	highest := bits.Len(uint(d)) - 1
+	second := (d >> (highest - 1)) & 1
+	extraBits = highest - 1
+
+	return 2*highest + second, extraBits, uint32(d) & (1<<extraBits - 1)
+}
+
+// prefixCode is a canonical prefix code, held as the length and the bit-reversed code for
+// each symbol, ready to be written least significant bit first
+type prefixCode struct {
+	lengths []int
+	codes   []uint32
+	symbols []int
+}
+
+// newPrefixCode builds a canonical prefix code for the symbols used in histogram, with no
+// code longer than maxLength bits
+func newPrefixCode(histogram []int, maxLength int) prefixCode {
+	code := prefixCode{
+		lengths: make([]int, len(histogram)),
+		codes:   make([]uint32, len(histogram)),
+	}
+
+	for symbol, count := range histogram {
+		if count > 0 {
+			code.symbols = append(code.symbols, symbol)
+		}
+	}
+
+	switch len(code.symbols) {
+	case 0:
+		// nothing is written with this code, but it still has to be valid
+		code.symbols = []int{0}
+		fallthrough
+	case 1:
+		// a code with a single symbol is written with zero bits
+		code.lengths[code.symbols[0]] = 1
+		return code
+	}
+
+	// If the Huffman code is too deep, flatten the histogram and try again. It converges
+	// quickly, as every pass halves the difference between the rarest and commonest symbols
+	counts := append([]int(nil), histogram...)
+	for {
+		huffmanLengths(counts, code.lengths)
+
+		longest := 0
+		for _, length := range code.lengths {
+			longest = max(longest, length)
+		}
+
+		if longest <= maxLength {
+			break
+		}
+
+		for i, count := range counts {
+			if count > 0 {
+				counts[i] = (count + 1) / 2
+			}
+		}
+	}
+
+	// assign the codes in order of length, then symbol
+	lengthCounts := make([]int, maxLength+1)
+	for _, length := range code.lengths {
+		lengthCounts[length]++
+	}
+	lengthCounts[0] = 0
+
+	next := make([]uint32, maxLength+1)
+	var c uint32
+	for length := 1; length <= maxLength; length++ {
+		c = (c + uint32(lengthCounts[length-1])) << 1
+		next[length] = c
+	}
+
+	for symbol, length := range code.lengths {
+		if length > 0 {
+			code.codes[symbol] = bits.Reverse32(next[length]) >> (32 - length)
+			next[length]++
+		}
+	}
+
+	return code
+}
+
+// huffmanLengths sets lengths to the Huffman code lengths for counts
+func huffmanLengths(counts []int, lengths []int) {
+	type node struct {
+		count       int
+		symbol      int
+		left, right *node
+	}
+
+	var nodes []*node
+	for symbol, count := range counts {
+		lengths[symbol] = 0
+		if count > 0 {
+			nodes = append(nodes, &node{count: count, symbol: symbol})
+		}
+	}
+
+	// Repeatedly merge the two least common nodes. The leaves are sorted once, and as each
+	// merged node is at least as common as the one before it, they can be kept in a queue of
+	// their own rather than a heap
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].count < nodes[j].count })
+
+	var merged []*node
+
+	smallest := func() *node {
+		if len(merged) == 0 || (len(nodes) > 0 && nodes[0].count <= merged[0].count) {
+			n := nodes[0]
+			nodes = nodes[1:]
+			return n
+		}
+		n := merged[0]
+		merged = merged[1:]
+		return n
+	}
+
+	for len(nodes)+len(merged) > 1 {
+		a := smallest()
+		b := smallest()
+		merged = append(merged, &node{count: a.count + b.count, symbol: -1, left: a, right: b})
+	}
+
+	var walk func(n *node, depth int)
+	walk = func(n *node, depth int) {
+		if n.symbol >= 0 {
+			lengths[n.symbol] = depth
+			return
+		}
+		walk(n.left, depth+1)
+		walk(n.right, depth+1)
+	}
+
+	walk(merged[0], 0)
+}
+
+// write writes symbol using the code. Codes with only one symbol take no bits at all
+func (c prefixCode) write(bw *bitWriter, symbol int) {
+	if len(c.symbols) == 1 {
+		return
+	}
+
+	bw.writeBits(c.codes[symbol], c.lengths[symbol])
+}
+
+// writePrefixCode writes the description of a prefix code which the decoder rebuilds it from
+func writePrefixCode(bw *bitWriter, code prefixCode) {
+	// Codes for one or two symbols below 256 have a compact form which lists the symbols
+	if len(code.symbols) <= 2 && code.symbols[len(code.symbols)-1] < 256 {
+		bw.writeBits(1, 1)
+		bw.writeBits(uint32(len(code.symbols)-1), 1)
+
+		first := code.symbols[0]
+		if first < 2 {
+			bw.writeBits(0, 1)
+			bw.writeBits(uint32(first), 1)
+		} else {
+			bw.writeBits(1, 1)
+			bw.writeBits(uint32(first), 8)
+		}
+
+		if len(code.symbols) == 2 {
+			bw.writeBits(uint32(code.symbols[1]), 8)
+		}
+
+		return
+	}
+
+	// Otherwise the code lengths are written out, compressed with a prefix code of their own.
+	// Runs of zeros use the repeat symbols 17 and 18, and everything else is written literally
+	type codeLength struct {
+		symbol int
+		extra  uint32
+		bits   int
+	}
+
+	var lengths []codeLength
+
+	for i := 0; i < len(code.lengths); {
+		if code.lengths[i] != 0 {
+			lengths = append(lengths, codeLength{symbol: code.lengths[i]})
+			i++
+			continue
+		}
+
+		run := 0
+		for i+run < len(code.lengths) && code.lengths[i+run] == 0 && run < 138 {
+			run++
+		}
+
+		switch {
+		case run >= 11:
+			lengths = append(lengths, codeLength{symbol: 18, extra: uint32(run - 11), bits: 7})
+		case run >= 3:
+			lengths = append(lengths, codeLength{symbol: 17, extra: uint32(run - 3), bits: 3})
+		default:
+			for j := 0; j < run; j++ {
+				lengths = append(lengths, codeLength{symbol: 0})
+			}
+		}
+
+		i += run
+	}
+
+	histogram := make([]int, len(codeLengthCodeOrder))
+	for _, l := range lengths {
+		histogram[l.symbol]++
+	}
+
+	lengthCode := newPrefixCode(histogram, maxCodeLengthCodeLength)
+
+	count := len(codeLengthCodeOrder)
+	for count > 4 && lengthCode.lengths[codeLengthCodeOrder[count-1]] == 0 {
+		count--
+	}
+
+	bw.writeBits(0, 1)
+	bw.writeBits(uint32(count-4), 4)
+	for _, symbol := range codeLengthCodeOrder[:count] {
+		bw.writeBits(uint32(lengthCode.lengths[symbol]), 3)
+	}
+
+	// every symbol in the alphabet has its length written, rather than stopping early
+	bw.writeBits(0, 1)
+
+	for _, l := range lengths {
+		lengthCode.write(bw, l.symbol)
+		bw.writeBits(l.extra, l.bits)
+	}
+}
+
+// bitWriter packs values into bytes least significant bit first, as VP8L requires
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits int
+}
+
+func (bw *bitWriter) writeBits(value uint32, n int) {
+	bw.acc |= uint64(value&(1<<n-1)) << bw.nbits
+	bw.nbits += n
+
+	for bw.nbits >= 8 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc >>= 8
+		bw.nbits -= 8
+	}
+}
+
+// bytes returns everything written so far, with the last byte padded with zeros
+func (bw *bitWriter) bytes() []byte {
+	if bw.nbits > 0 {
+		return append(bw.buf, byte(bw.acc))
+	}
+	return bw.buf
+}
@@ -0,0 +1,42 @@
+CREATE TABLE IF NOT EXISTS series (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    title text NOT NULL,
+    year integer NOT NULL,
+    genres text[] NOT NULL,
+    version integer NOT NULL DEFAULT 1
+);
+
+ALTER TABLE series ADD CONSTRAINT series_year_check CHECK ( year BETWEEN 1888 and date_part('year', now()));
+ALTER TABLE series ADD CONSTRAINT series_genres_length_check CHECK ( array_length(genres, 1) BETWEEN 1 AND 5);
+
+CREATE INDEX IF NOT EXISTS series_title_idx ON series USING GIN (to_tsvector('simple', title));
+CREATE INDEX IF NOT EXISTS series_genres_idx ON series USING GIN (genres);
+
+CREATE TABLE IF NOT EXISTS seasons (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    series_id bigint NOT NULL REFERENCES series ON DELETE CASCADE,
+    number integer NOT NULL,
+    title text NOT NULL DEFAULT '',
+    year integer NOT NULL,
+    version integer NOT NULL DEFAULT 1,
+    UNIQUE (series_id, number)
+);
+
+ALTER TABLE seasons ADD CONSTRAINT seasons_number_check CHECK ( number >= 0 );
+ALTER TABLE seasons ADD CONSTRAINT seasons_year_check CHECK ( year BETWEEN 1888 and date_part('year', now()));
+
+CREATE TABLE IF NOT EXISTS episodes (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    season_id bigint NOT NULL REFERENCES seasons ON DELETE CASCADE,
+    number integer NOT NULL,
+    title text NOT NULL,
+    runtime integer NOT NULL,
+    version integer NOT NULL DEFAULT 1,
+    UNIQUE (season_id, number)
+);
+
+ALTER TABLE episodes ADD CONSTRAINT episodes_number_check CHECK ( number >= 1 );
+ALTER TABLE episodes ADD CONSTRAINT episodes_runtime_check CHECK ( runtime >= 0 );
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS movie_images (
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    kind text NOT NULL,
+    storage_key text NOT NULL,
+    content_type text NOT NULL,
+    size bigint NOT NULL,
+    width integer NOT NULL,
+    height integer NOT NULL,
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1,
+    PRIMARY KEY (movie_id, kind)
+);
+
+ALTER TABLE movie_images ADD CONSTRAINT movie_images_kind_check CHECK ( kind IN ('poster', 'backdrop') );
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS external_ids (
+    source text NOT NULL,
+    value text NOT NULL,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (source, value),
+    UNIQUE (movie_id, source)
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS movie_translations;
+ALTER TABLE movies DROP COLUMN IF EXISTS synopsis;
@@ -0,0 +1,12 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS synopsis text NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS movie_translations (
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    locale text NOT NULL,
+    title text NOT NULL,
+    synopsis text NOT NULL DEFAULT '',
+    version integer NOT NULL DEFAULT 1,
+    PRIMARY KEY (movie_id, locale)
+);
+
+CREATE INDEX IF NOT EXISTS movie_translations_title_idx ON movie_translations USING GIN (to_tsvector('simple', title));
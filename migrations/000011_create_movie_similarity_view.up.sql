@@ -0,0 +1,22 @@
+-- movie_similarity holds a precomputed similarity score for every pair of movies which
+-- share at least one genre. The score combines the Jaccard index of the two genre sets
+-- with how close together the movies were released. Once reviews exist, a co-rating
+-- term can be added to the score here without any changes to the API.
+CREATE MATERIALIZED VIEW IF NOT EXISTS movie_similarity AS
+SELECT a.id AS movie_id,
+       b.id AS similar_movie_id,
+       s.genre_score,
+       s.year_score,
+       round((0.7 * s.genre_score + 0.3 * s.year_score)::numeric, 4)::float8 AS score
+FROM movies a
+INNER JOIN movies b ON a.id <> b.id AND a.genres && b.genres
+CROSS JOIN LATERAL (
+    SELECT cardinality(ARRAY(SELECT unnest(a.genres) INTERSECT SELECT unnest(b.genres)))::float8
+               / cardinality(ARRAY(SELECT unnest(a.genres) UNION SELECT unnest(b.genres)))::float8 AS genre_score,
+           1.0 / (1.0 + abs(a.year - b.year) / 5.0) AS year_score
+) s
+WITH DATA;
+
+-- REFRESH MATERIALIZED VIEW CONCURRENTLY requires a unique index on the view
+CREATE UNIQUE INDEX IF NOT EXISTS movie_similarity_pair_idx ON movie_similarity (movie_id, similar_movie_id);
+CREATE INDEX IF NOT EXISTS movie_similarity_score_idx ON movie_similarity (movie_id, score DESC);
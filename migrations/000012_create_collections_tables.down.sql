@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'collections:admin';
+DROP TABLE IF EXISTS collections_movies;
+DROP TABLE IF EXISTS collections;
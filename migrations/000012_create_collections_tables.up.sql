@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS collections (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL,
+    description text NOT NULL DEFAULT '',
+    kind text NOT NULL,
+    owner_id bigint REFERENCES users ON DELETE SET NULL,
+    version integer NOT NULL DEFAULT 1
+);
+
+ALTER TABLE collections ADD CONSTRAINT collections_kind_check CHECK ( kind IN ('franchise', 'curated') );
+
+CREATE INDEX IF NOT EXISTS collections_name_idx ON collections USING GIN (to_tsvector('simple', name));
+
+CREATE TABLE IF NOT EXISTS collections_movies (
+    collection_id bigint NOT NULL REFERENCES collections ON DELETE CASCADE,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    position integer NOT NULL,
+    PRIMARY KEY (collection_id, movie_id)
+);
+
+CREATE INDEX IF NOT EXISTS collections_movies_movie_id_idx ON collections_movies (movie_id);
+
+INSERT INTO permissions (code)
+VALUES
+    ('collections:admin');
@@ -0,0 +1,6 @@
+DELETE FROM permissions WHERE code = 'permissions:admin';
+
+DROP TABLE IF EXISTS audit_events;
+
+ALTER TABLE permissions DROP CONSTRAINT IF EXISTS permissions_code_key;
+ALTER TABLE permissions DROP COLUMN IF EXISTS description;
@@ -0,0 +1,25 @@
+ALTER TABLE permissions ADD COLUMN IF NOT EXISTS description text NOT NULL DEFAULT '';
+
+ALTER TABLE permissions ADD CONSTRAINT permissions_code_key UNIQUE (code);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    actor_id bigint REFERENCES users ON DELETE SET NULL,
+    action text NOT NULL,
+    target_type text NOT NULL,
+    target_id text NOT NULL,
+    details jsonb NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_target_idx ON audit_events (target_type, target_id);
+CREATE INDEX IF NOT EXISTS audit_events_created_at_idx ON audit_events (created_at);
+
+UPDATE permissions SET description = 'View movies, series and collections' WHERE code = 'movies:read';
+UPDATE permissions SET description = 'Create, edit and delete movies, series and collections' WHERE code = 'movies:write';
+UPDATE permissions SET description = 'Edit and delete curated collections owned by other users' WHERE code = 'collections:admin';
+UPDATE permissions SET description = 'Manage user accounts' WHERE code = 'users:admin';
+
+INSERT INTO permissions (code, description)
+VALUES
+    ('permissions:admin', 'Define permission codes and grant them to users');
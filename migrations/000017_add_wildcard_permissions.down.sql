@@ -0,0 +1,8 @@
+DELETE FROM permissions
+WHERE code IN ('*', 'movies:*');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'admin'
+ON CONFLICT DO NOTHING;
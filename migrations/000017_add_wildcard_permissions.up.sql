@@ -0,0 +1,16 @@
+INSERT INTO permissions (code, description)
+VALUES
+    ('*', 'Every permission, including ones defined later'),
+    ('movies:*', 'Every movies permission');
+
+-- the admin role should keep up with new permission codes, so give it the wildcard
+-- rather than the list of codes which happened to exist when it was created
+DELETE FROM role_permissions
+USING roles
+WHERE role_permissions.role_id = roles.id
+AND roles.name = 'admin';
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = '*';
@@ -0,0 +1,7 @@
+DELETE FROM roles
+WHERE name = 'contributor';
+
+DELETE FROM permissions
+WHERE code = 'movies:write:own';
+
+ALTER TABLE movies DROP COLUMN IF EXISTS created_by;
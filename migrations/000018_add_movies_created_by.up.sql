@@ -0,0 +1,14 @@
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+
+INSERT INTO permissions (code, description)
+VALUES
+    ('movies:write:own', 'Add movies, and edit or delete the movies you added');
+
+INSERT INTO roles (name, description)
+VALUES
+    ('contributor', 'Can browse the catalog, and add and edit their own movies');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'contributor' AND permissions.code IN ('movies:read', 'movies:write:own');
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS user_totp;
+
+DELETE FROM tokens
+WHERE scope = '2fa-pending';
+
+ALTER TABLE tokens DROP COLUMN IF EXISTS attempts;
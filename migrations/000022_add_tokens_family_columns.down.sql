@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS tokens_family_idx;
+
+ALTER TABLE tokens
+    DROP COLUMN IF EXISTS used_at,
+    DROP COLUMN IF EXISTS family;
+
+DROP SEQUENCE IF EXISTS tokens_family_seq;
@@ -0,0 +1,7 @@
+CREATE SEQUENCE IF NOT EXISTS tokens_family_seq;
+
+ALTER TABLE tokens
+    ADD COLUMN IF NOT EXISTS family bigint NOT NULL DEFAULT nextval('tokens_family_seq'),
+    ADD COLUMN IF NOT EXISTS used_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family);
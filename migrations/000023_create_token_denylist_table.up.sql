@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS token_denylist (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    session bigint,
+    issued_before timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS token_denylist_expiry_idx ON token_denylist (expiry);
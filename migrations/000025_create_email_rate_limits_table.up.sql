@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS email_rate_limits (
+    kind text NOT NULL,
+    email citext NOT NULL,
+    tat timestamp with time zone NOT NULL,
+    PRIMARY KEY (kind, email)
+);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS user_identities (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    issuer text NOT NULL,
+    subject text NOT NULL,
+    email citext NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    UNIQUE (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+
+CREATE TABLE IF NOT EXISTS oidc_states (
+    hash bytea PRIMARY KEY,
+    binding_hash bytea NOT NULL,
+    verifier text NOT NULL,
+    nonce text NOT NULL,
+    expiry timestamp(0) with time zone NOT NULL
+);